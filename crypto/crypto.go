@@ -13,6 +13,8 @@ func NewAESKey() []byte {
 	return keyBuf
 }
 
+// Deprecated: CopyEncrypt writes unauthenticated AES-CTR blobs. Use
+// NewEncryptReader; NewDecryptReader still reads blobs written by this.
 func CopyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
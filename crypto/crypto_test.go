@@ -2,6 +2,9 @@ package crypto
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -24,3 +27,108 @@ func TestCrypto(t *testing.T) {
 	assert.Equal(t, 16+len(payload), n)
 	assert.Equal(t, payload, out.String())
 }
+
+func encryptBlob(t *testing.T, key, data []byte) []byte {
+	r, err := NewEncryptReader(key, bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	blob, err := io.ReadAll(r)
+	assert.Nil(t, err)
+
+	return blob
+}
+
+func decryptBlob(key, blob []byte) ([]byte, error) {
+	r, err := NewDecryptReader(key, bytes.NewReader(blob))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+func TestEncryptReaderRoundTrip(t *testing.T) {
+	key := NewAESKey()
+
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		blob := encryptBlob(t, key, data)
+		chunks := max(1, (size+ChunkSize-1)/ChunkSize)
+		assert.Equal(t, headerSize+size+16*chunks, len(blob))
+
+		out, err := decryptBlob(key, blob)
+		assert.Nil(t, err)
+		assert.Equal(t, data, out, "size %d", size)
+	}
+}
+
+func TestDecryptReaderDetectsTampering(t *testing.T) {
+	key := NewAESKey()
+	data := bytes.Repeat([]byte("random data"), ChunkSize/4)
+	blob := encryptBlob(t, key, data)
+
+	flipped := bytes.Clone(blob)
+	flipped[len(flipped)/2] ^= 0x01
+	_, err := decryptBlob(key, flipped)
+	assert.ErrorIs(t, err, ErrAuthFailed)
+
+	truncated := blob[:headerSize+ChunkSize+16]
+	_, err = decryptBlob(key, truncated)
+	assert.ErrorIs(t, err, ErrAuthFailed)
+
+	extended := append(bytes.Clone(blob), blob[headerSize:headerSize+ChunkSize+16]...)
+	_, err = decryptBlob(key, extended)
+	assert.ErrorIs(t, err, ErrAuthFailed)
+
+	_, err = decryptBlob(NewAESKey(), blob)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+}
+
+func TestDecryptReaderReadsLegacyBlobs(t *testing.T) {
+	key := NewAESKey()
+	payload := []byte("random data written before the gcm format")
+
+	legacy := new(bytes.Buffer)
+	_, err := CopyEncrypt(key, bytes.NewReader(payload), legacy)
+	assert.Nil(t, err)
+
+	out, err := decryptBlob(key, legacy.Bytes())
+	assert.Nil(t, err)
+	assert.Equal(t, payload, out)
+}
+
+func TestEncryptReaderUsesPerBlobKeys(t *testing.T) {
+	key := NewAESKey()
+	data := []byte("same data")
+
+	a, b := encryptBlob(t, key, data), encryptBlob(t, key, data)
+	assert.NotEqual(t, a[baseHeaderSize:headerSize], b[baseHeaderSize:headerSize])
+	assert.NotEqual(t, a[headerSize:], b[headerSize:])
+
+	// The salt is authenticated along with the rest of the header.
+	a[baseHeaderSize] ^= 0x01
+	_, err := decryptBlob(key, a)
+	assert.ErrorIs(t, err, ErrAuthFailed)
+}
+
+func TestDecryptReaderReadsVersion1Blobs(t *testing.T) {
+	key := NewAESKey()
+	payload := []byte("random data written with a nonce prefix")
+
+	prefix := make([]byte, noncePrefixSize)
+	rand.Read(prefix)
+	header := append(bytes.Clone(formatMagic), 1)
+	header = append(header, KeyID(key)...)
+	header = binary.BigEndian.AppendUint32(header, ChunkSize)
+	header = append(header, prefix...)
+
+	aead, err := newGCM(key)
+	assert.Nil(t, err)
+	blob := aead.Seal(bytes.Clone(header), chunkNonce(prefix, 0, true), payload, header)
+
+	out, err := decryptBlob(key, blob)
+	assert.Nil(t, err)
+	assert.Equal(t, payload, out)
+}
@@ -0,0 +1,305 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Blobs written by NewEncryptReader start with a header
+//
+//	magic (8) | version (1) | key ID (8) | chunk size (4) | salt (32)
+//
+// followed by AES-GCM sealed chunks of chunk size plaintext bytes. Each blob
+// is sealed with its own subkey, derived from the key and the random salt with
+// HKDF, so nonces never repeat across blobs. The nonce for chunk i is i as a 4
+// byte counter and a final chunk flag, and the header is authenticated with
+// every chunk, so reordering, truncating or extending the stream all fail
+// authentication.
+//
+// Version 1 blobs carried a random 7 byte nonce prefix in place of the salt
+// and were sealed with the key itself. They are still read.
+const (
+	FormatVersion = 2
+
+	magicSize       = 8
+	keyIDSize       = 8
+	saltSize        = 32
+	noncePrefixSize = 7
+	baseHeaderSize  = magicSize + 1 + keyIDSize + 4
+	headerSize      = baseHeaderSize + saltSize
+	v1HeaderSize    = baseHeaderSize + noncePrefixSize
+	ChunkSize       = 64 << 10
+	maxChunkSize    = 4 << 20
+
+	blobKeyInfo = "scatterfs blob key"
+)
+
+var (
+	formatMagic = []byte("SCFSBLOB")
+
+	ErrKeyMismatch        = errors.New("blob was encrypted with a different key")
+	ErrAuthFailed         = errors.New("blob chunk failed authentication")
+	ErrUnsupportedVersion = errors.New("unsupported blob format version")
+	ErrBlobTooLarge       = errors.New("blob exceeds the maximum number of chunks")
+)
+
+func KeyID(key []byte) []byte {
+	digest := sha256.Sum256(append([]byte("scatterfs key id"), key...))
+	return digest[:keyIDSize]
+}
+
+// blobKey derives the subkey a blob with the given salt is sealed with.
+func blobKey(key, salt []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, key, salt, blobKeyInfo, len(key))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+type encryptReader struct {
+	aead    cipher.AEAD
+	header  []byte
+	src     io.Reader
+	plain   []byte
+	carry   []byte
+	counter uint32
+	out     []byte
+	done    bool
+}
+
+// NewEncryptReader returns a reader yielding the authenticated, chunked
+// encryption of everything read from src.
+func NewEncryptReader(key []byte, src io.Reader) (io.Reader, error) {
+	// Reject a bad key before deriving from it, as HKDF takes any length.
+	if _, err := aes.NewCipher(key); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	subkey, err := blobKey(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(subkey)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, formatMagic...)
+	header = append(header, FormatVersion)
+	header = append(header, KeyID(key)...)
+	header = binary.BigEndian.AppendUint32(header, ChunkSize)
+	header = append(header, salt...)
+
+	return &encryptReader{
+		aead:   aead,
+		header: header,
+		src:    src,
+		plain:  make([]byte, ChunkSize+1),
+		out:    bytes.Clone(header),
+	}, nil
+}
+
+func (e *encryptReader) Read(b []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, e.out)
+	e.out = e.out[n:]
+
+	return n, nil
+}
+
+// sealNext reads one byte past the chunk so it knows whether the chunk is
+// the final one before sealing it.
+func (e *encryptReader) sealNext() error {
+	n := copy(e.plain, e.carry)
+	m, err := io.ReadFull(e.src, e.plain[n:])
+	n += m
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := n <= ChunkSize
+	if !last && e.counter == math.MaxUint32 {
+		return ErrBlobTooLarge
+	}
+	chunk := e.plain[:min(n, ChunkSize)]
+	e.carry = e.carry[:0]
+	if !last {
+		e.carry = append(e.carry, e.plain[ChunkSize:n]...)
+	}
+
+	e.out = e.aead.Seal(e.out[:0], chunkNonce(nil, e.counter, last), chunk, e.header)
+	e.counter++
+	e.done = last
+
+	return nil
+}
+
+type decryptReader struct {
+	aead      cipher.AEAD
+	header    []byte
+	prefix    []byte
+	chunkSize int
+	src       io.Reader
+	sealed    []byte
+	carry     []byte
+	counter   uint32
+	out       []byte
+	done      bool
+}
+
+// NewDecryptReader returns a reader yielding the plaintext of a blob written
+// by NewEncryptReader. Blobs without the format header are treated as legacy
+// AES-CTR blobs written by CopyEncrypt, which carry no authentication.
+func NewDecryptReader(key []byte, src io.Reader) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, magicSize)
+	if _, err := io.ReadFull(src, head); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(head, formatMagic) {
+		iv := make([]byte, block.BlockSize())
+		copy(iv, head)
+		if _, err := io.ReadFull(src, iv[magicSize:]); err != nil {
+			return nil, err
+		}
+		return cipher.StreamReader{S: cipher.NewCTR(block, iv), R: src}, nil
+	}
+
+	header := make([]byte, baseHeaderSize, headerSize)
+	copy(header, head)
+	if _, err := io.ReadFull(src, header[magicSize:]); err != nil {
+		return nil, err
+	}
+
+	size := headerSize
+	switch header[magicSize] {
+	case FormatVersion:
+	case 1:
+		size = v1HeaderSize
+	default:
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header[magicSize])
+	}
+	if !bytes.Equal(header[magicSize+1:magicSize+1+keyIDSize], KeyID(key)) {
+		return nil, ErrKeyMismatch
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[magicSize+1+keyIDSize:]))
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, fmt.Errorf("invalid blob chunk size %d", chunkSize)
+	}
+
+	header = header[:size]
+	if _, err := io.ReadFull(src, header[baseHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	var prefix []byte
+	if size == v1HeaderSize {
+		prefix = header[baseHeaderSize:]
+	} else if key, err = blobKey(key, header[baseHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		aead:      aead,
+		header:    header,
+		prefix:    prefix,
+		chunkSize: chunkSize,
+		src:       src,
+		sealed:    make([]byte, chunkSize+aead.Overhead()+1),
+	}, nil
+}
+
+func (d *decryptReader) Read(b []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.openNext(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, d.out)
+	d.out = d.out[n:]
+
+	return n, nil
+}
+
+func (d *decryptReader) openNext() error {
+	full := d.chunkSize + d.aead.Overhead()
+
+	n := copy(d.sealed, d.carry)
+	m, err := io.ReadFull(d.src, d.sealed[n:])
+	n += m
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	last := n <= full
+	chunk := d.sealed[:min(n, full)]
+
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.counter, last), chunk, d.header)
+	if err != nil {
+		return ErrAuthFailed
+	}
+
+	d.carry = d.carry[:0]
+	if !last {
+		d.carry = append(d.carry, d.sealed[full:n]...)
+	}
+	d.out = plain
+	d.counter++
+	d.done = last
+
+	return nil
+}
@@ -1,6 +1,6 @@
 module github.com/AaravShirvoikar/scatterfs
 
-go 1.23.4
+go 1.24.0
 
 require github.com/stretchr/testify v1.10.0
 
@@ -0,0 +1,158 @@
+package fileserver
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const defaultRepairInterval = time.Minute
+
+// MessageSyncTree carries the sender's hashes for some nodes of the Merkle
+// tree over the keys it shares with the receiver. The receiver replies with
+// the nodes its own tree disagrees on.
+type MessageSyncTree struct {
+	ID     uint64
+	Nodes  []uint32
+	Hashes [][]byte
+}
+
+// MessageSyncKeys asks for the receiver's entries in the given leaves.
+type MessageSyncKeys struct {
+	ID     uint64
+	Leaves []uint32
+}
+
+// syncEntries returns the files this node holds that peer should also hold,
+// meaning both of them are replicas of the key.
+func (s *FileServer) syncEntries(peer string) ([]SyncEntry, map[string]*storage.Manifest, error) {
+	all, err := s.storage.Manifests()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entries := []SyncEntry{}
+	manifests := make(map[string]*storage.Manifest)
+	for _, m := range all {
+		if m.Key == "" || s.tombstoneExpired(m) {
+			continue
+		}
+
+		owners := s.ring.Owners(m.Key, s.replicationFactor)
+		if !slices.Contains(owners, s.id) || !slices.Contains(owners, peer) {
+			continue
+		}
+
+		entries = append(entries, syncEntryOf(m))
+		manifests[m.Key] = m
+	}
+
+	return entries, manifests, nil
+}
+
+// syncWith compares the files this node shares with peer and pushes the
+// ones peer is missing or holds an older version of. Files only peer has
+// are left to peer's own sync, so every exchange is one-way.
+func (s *FileServer) syncWith(peer p2p.Peer) error {
+	s.metrics.syncRounds.Add(1)
+
+	entries, manifests, err := s.syncEntries(peer.ID())
+	if err != nil {
+		return err
+	}
+	tree := newMerkleTree(entries)
+
+	var leaves []uint32
+	for nodes := []uint32{1}; leaves == nil; {
+		resp, err := s.call(peer, func(id uint64) any {
+			return MessageSyncTree{ID: id, Nodes: nodes, Hashes: tree.hashes(nodes)}
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Diff) == 0 {
+			return nil
+		}
+
+		// Every node sent in a round is on the same level, so are the diffs.
+		if isLeaf(resp.Diff[0]) {
+			leaves = resp.Diff
+		} else {
+			nodes = descend(resp.Diff)
+		}
+	}
+
+	resp, err := s.call(peer, func(id uint64) any {
+		return MessageSyncKeys{ID: id, Leaves: leaves}
+	})
+	if err != nil {
+		return err
+	}
+
+	theirs := make(map[string]SyncEntry, len(resp.Entries))
+	for _, e := range resp.Entries {
+		theirs[e.Key] = e
+	}
+
+	for _, e := range tree.leafEntries(leaves) {
+		if t, ok := theirs[e.Key]; ok && !e.supersedes(t) {
+			continue
+		}
+
+		if err := s.replicate(peer, e.Key, manifests[e.Key]); err != nil {
+			s.metrics.repairErrors.Add(1)
+			log.Printf("[%s] failed to repair file %s on %s: %v", s.transport.Addr(), e.Key, peer.ID(), err)
+			continue
+		}
+		s.metrics.keysRepaired.Add(1)
+
+		log.Printf("[%s] repaired file %s on %s", s.transport.Addr(), e.Key, peer.ID())
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageSyncTree(from string, msg MessageSyncTree) error {
+	entries, _, err := s.syncEntries(from)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
+
+	diff, err := newMerkleTree(entries).diff(msg.Nodes, msg.Hashes)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
+
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK, Diff: diff})
+}
+
+func (s *FileServer) handleMessageSyncKeys(from string, msg MessageSyncKeys) error {
+	entries, _, err := s.syncEntries(from)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
+
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK, Entries: newMerkleTree(entries).leafEntries(msg.Leaves)})
+}
+
+func (s *FileServer) repairLoop() {
+	ticker := time.NewTicker(s.repairInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range s.peerList() {
+				if err := s.syncWith(peer); err != nil {
+					s.metrics.repairErrors.Add(1)
+					log.Printf("[%s] anti-entropy with %s failed: %v", s.transport.Addr(), peer.ID(), err)
+				}
+			}
+		case <-s.quitChan:
+			return
+		}
+	}
+}
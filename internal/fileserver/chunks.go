@@ -0,0 +1,392 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/crypto"
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const (
+	gcInterval       = time.Minute * 10
+	chunkGracePeriod = time.Hour
+)
+
+func hashChunk(b []byte) string {
+	digest := sha256.Sum256(b)
+	return hex.EncodeToString(digest[:])
+}
+
+// writeChunks splits r into content-defined chunks, stores the ones this node
+// does not have yet and returns the manifest describing the file.
+func (s *FileServer) writeChunks(r io.Reader) (*storage.Manifest, error) {
+	m := &storage.Manifest{}
+	digest := sha256.New()
+	chunker := storage.NewChunker(io.TeeReader(r, digest))
+
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			m.SHA256 = hex.EncodeToString(digest.Sum(nil))
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hash := hashChunk(chunk)
+		if err := s.writeChunk(hash, chunk); err != nil {
+			return nil, err
+		}
+
+		m.Chunks = append(m.Chunks, storage.ChunkRef{Hash: hash, Size: int64(len(chunk))})
+		m.Size += int64(len(chunk))
+	}
+}
+
+func (s *FileServer) writeChunk(hash string, data []byte) error {
+	enc, err := crypto.NewEncryptReader(s.encKey, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.storage.WriteChunk(hash, enc)
+	return err
+}
+
+func (s *FileServer) readChunk(hash string) (io.ReadCloser, error) {
+	r, err := s.storage.ReadChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := crypto.NewDecryptReader(s.encKey, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: dec, Closer: r}, nil
+}
+
+// readLegacy reads a file stored whole, as one encrypted blob under its key,
+// by nodes from before files were split into chunks.
+func (s *FileServer) readLegacy(key string) (io.ReadCloser, error) {
+	r, err := s.storage.ReadBlob(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := crypto.NewDecryptReader(s.encKey, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return readCloser{Reader: dec, Closer: r}, nil
+}
+
+// missingChunks returns, in manifest order and without duplicates, the
+// hashes of the chunks this node does not hold.
+func (s *FileServer) missingChunks(hashes []string) []string {
+	seen := make(map[string]bool)
+	missing := []string{}
+
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		if !s.storage.HasChunk(hash) {
+			missing = append(missing, hash)
+		}
+	}
+
+	return missing
+}
+
+// sendChunks writes the chunks to stream, verifying each one first so a
+// corrupt local copy is never passed on.
+func (s *FileServer) sendChunks(stream *p2p.Stream, hashes []string) error {
+	for _, hash := range hashes {
+		data, err := s.readVerifiedChunk(hash)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stream.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *FileServer) receiveChunks(stream *p2p.Stream, m *storage.Manifest, hashes []string) error {
+	chunks := m.AllChunks()
+	sizes := make(map[string]int64, len(chunks))
+	for _, c := range chunks {
+		sizes[c.Hash] = c.Size
+	}
+
+	for _, hash := range hashes {
+		size, ok := sizes[hash]
+		if !ok {
+			return fmt.Errorf("chunk %s is not part of the manifest", hash)
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(stream, chunk); err != nil {
+			return err
+		}
+
+		if hashChunk(chunk) != hash {
+			return fmt.Errorf("chunk %s failed hash verification", hash)
+		}
+
+		if err := s.writeChunk(hash, chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replicate sends the manifest and only the chunks peer is missing.
+func (s *FileServer) replicate(peer p2p.Peer, key string, m *storage.Manifest) error {
+	resp, err := s.call(peer, func(id uint64) any {
+		return MessageHave{ID: id, Hashes: m.Hashes()}
+	})
+	if err != nil {
+		return err
+	}
+	missing := resp.Missing
+
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return err
+	}
+
+	req, err := s.sendRequest(peer, func(id uint64) any {
+		return MessageStore{
+			ID:       id,
+			Key:      key,
+			Manifest: m,
+			Chunks:   missing,
+			StreamID: stream.ID(),
+		}
+	})
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	defer s.closeRequest(req)
+
+	if err := s.sendChunks(stream, missing); err != nil {
+		stream.Reset()
+		return err
+	}
+	stream.Close()
+
+	if _, err := s.awaitResponse(req, peer); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] replicated file %s to %s, sent %d of %d chunks", s.transport.Addr(), key, peer.ID(), len(missing), len(m.Chunks))
+
+	return nil
+}
+
+// fileReader streams a file by reading its chunks in manifest order, taking
+// each one from local storage or, if it was missing locally, from remote.
+// Every chunk is verified against its hash before any of it is returned, and
+// the whole file against the manifest's SHA-256 at the end. A chunk that
+// fails verification is fetched again from another replica.
+type fileReader struct {
+	s          *FileServer
+	m          *storage.Manifest
+	agreed     []string
+	fromRemote map[string]bool
+	remote     io.ReadCloser
+	remoteFrom string
+	remoteErr  error
+	// reuse holds remote chunks the file repeats, with how many more times
+	// each is needed, as the stream carries every chunk once.
+	reuse  map[string][]byte
+	uses   map[string]int
+	next   int
+	buf    []byte
+	digest hash.Hash
+	err    error
+}
+
+// newFileReader reads m's chunks from local storage, falling back to the
+// peers in agreed, which returned the same manifest.
+func (s *FileServer) newFileReader(m *storage.Manifest, agreed []string) *fileReader {
+	return &fileReader{
+		s:          s,
+		m:          m,
+		agreed:     agreed,
+		fromRemote: make(map[string]bool),
+		reuse:      make(map[string][]byte),
+		uses:       make(map[string]int),
+		digest:     sha256.New(),
+	}
+}
+
+// streamFrom takes the missing chunks, in manifest order, from the stream
+// peer opened for them.
+func (r *fileReader) streamFrom(peer string, missing []string, stream io.ReadCloser) {
+	for _, hash := range missing {
+		r.fromRemote[hash] = true
+	}
+	for _, c := range r.m.Chunks {
+		if r.fromRemote[c.Hash] {
+			r.uses[c.Hash]++
+		}
+	}
+
+	r.remote = stream
+	r.remoteFrom = peer
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.next == len(r.m.Chunks) {
+			r.err = io.EOF
+			if r.m.SHA256 != "" && hex.EncodeToString(r.digest.Sum(nil)) != r.m.SHA256 {
+				r.err = fmt.Errorf("file %s: %w", r.m.Key, ErrIntegrity)
+			}
+			continue
+		}
+
+		data, err := r.load(r.m.Chunks[r.next])
+		if err != nil {
+			r.err = err
+			continue
+		}
+		r.digest.Write(data)
+		r.buf = data
+		r.next++
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+func (r *fileReader) load(c storage.ChunkRef) ([]byte, error) {
+	if !r.fromRemote[c.Hash] {
+		return r.loadLocal(c)
+	}
+
+	data, ok := r.reuse[c.Hash]
+	if !ok {
+		var err error
+		if data, err = r.loadRemote(c); err != nil {
+			return nil, err
+		}
+	}
+
+	r.uses[c.Hash]--
+	if r.uses[c.Hash] > 0 {
+		r.reuse[c.Hash] = data
+	} else {
+		delete(r.reuse, c.Hash)
+	}
+
+	return data, nil
+}
+
+func (r *fileReader) loadLocal(c storage.ChunkRef) ([]byte, error) {
+	data, err := r.s.readLocalChunk(c)
+	if err == nil {
+		return data, nil
+	}
+
+	data, ferr := r.s.fetchChunk(c, r.s.fallbackPeers(r.m.Key, r.agreed, ""))
+	if ferr != nil {
+		return nil, errors.Join(err, ferr)
+	}
+
+	// Put an intact copy back in place of the one that was lost or discarded.
+	if err := r.s.writeChunk(c.Hash, data); err != nil {
+		log.Printf("[%s] failed to restore chunk %s: %v", r.s.transport.Addr(), c.Hash, err)
+	}
+
+	return data, nil
+}
+
+func (r *fileReader) loadRemote(c storage.ChunkRef) ([]byte, error) {
+	if r.remoteErr == nil {
+		data := make([]byte, c.Size)
+		_, err := io.ReadFull(r.remote, data)
+		if err == nil && hashChunk(data) == c.Hash {
+			return data, nil
+		}
+		if err == nil {
+			r.s.metrics.corruptChunks.Add(1)
+			err = fmt.Errorf("chunk %s: %w", c.Hash, ErrIntegrity)
+		}
+
+		// The stream can no longer be trusted to be in step, so every
+		// remaining remote chunk is fetched on its own.
+		r.remoteErr = err
+		log.Printf("[%s] stream of file %s from %s failed: %v", r.s.transport.Addr(), r.m.Key, r.remoteFrom, err)
+		if servedBadChunk(err) {
+			r.s.flagReplica(r.remoteFrom, c.Hash)
+		}
+	}
+
+	return r.s.fetchChunk(c, r.s.fallbackPeers(r.m.Key, r.agreed, r.remoteFrom))
+}
+
+func (r *fileReader) Close() error {
+	if r.remote != nil {
+		return r.remote.Close()
+	}
+	return nil
+}
+
+func (s *FileServer) gcLoop() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// Writes hold gcLock while their chunks are unreferenced, since
+			// a chunk they found already stored may be older than the grace
+			// period.
+			s.gcLock.Lock()
+			s.pruneTombstones()
+			s.pruneVersions()
+			n, err := s.storage.PruneChunks(chunkGracePeriod)
+			s.gcLock.Unlock()
+			if err != nil {
+				log.Printf("[%s] chunk garbage collection failed: %v", s.transport.Addr(), err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[%s] pruned %d unreferenced chunks", s.transport.Addr(), n)
+			}
+		case <-s.quitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package fileserver
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+// ConflictMode selects how replicas settle versions of a file written
+// concurrently, that is, where neither version vector descends from the
+// other.
+type ConflictMode int
+
+const (
+	// LastWriterWins keeps the version written last, with ties broken by
+	// digest so every replica keeps the same one.
+	LastWriterWins ConflictMode = iota
+	// KeepSiblings keeps every concurrent version until a write made with
+	// all of them in view resolves the conflict.
+	KeepSiblings
+)
+
+// ConflictError is returned by Get with WithConflicts when the file holds
+// concurrently written siblings. Each one can be read with WithVersion.
+type ConflictError struct {
+	Key      string
+	Versions []storage.Metadata
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("file %s has %d conflicting versions", e.Key, len(e.Versions))
+}
+
+func newConflictError(m *storage.Manifest) *ConflictError {
+	err := &ConflictError{Key: m.Key}
+	for _, head := range m.Heads() {
+		err.Versions = append(err.Versions, head.Metadata())
+	}
+
+	return err
+}
+
+// supersedes reports whether version a makes b obsolete: a was written with
+// b in view or, for versions written without version vectors, a is the
+// later write.
+func supersedes(a, b *storage.Manifest) bool {
+	if len(a.Clock) == 0 || len(b.Clock) == 0 {
+		return !syncEntryOf(b).newer(syncEntryOf(a))
+	}
+
+	return a.Clock.Descends(b.Clock)
+}
+
+// resolve merges the heads of incoming into local, either of which may be
+// nil, and returns the manifest to store, or nil if incoming brings nothing
+// local does not already supersede. Concurrent heads are ordered newest
+// first, the same way on every replica, and all but the first dropped
+// unless mode keeps siblings.
+func resolve(local, incoming *storage.Manifest, mode ConflictMode) *storage.Manifest {
+	var heads []*storage.Manifest
+	if local != nil {
+		heads = local.Heads()
+	}
+
+	changed := false
+	for _, in := range incoming.Heads() {
+		if slices.ContainsFunc(heads, func(h *storage.Manifest) bool { return supersedes(h, in) }) {
+			continue
+		}
+		heads = slices.DeleteFunc(heads, func(h *storage.Manifest) bool { return supersedes(in, h) })
+		heads = append(heads, in)
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	sort.Slice(heads, func(i, j int) bool { return syncEntryOf(heads[i]).newer(syncEntryOf(heads[j])) })
+	if mode == LastWriterWins {
+		heads = heads[:1]
+	}
+
+	m := *heads[0]
+	m.Siblings = heads[1:]
+	if local != nil && sameHeads(local, &m) {
+		return nil
+	}
+
+	return &m
+}
+
+// sameHeads reports whether a and b hold the same writes, which is the case
+// when incoming versions all lost to local ones by last-writer-wins.
+func sameHeads(a, b *storage.Manifest) bool {
+	return slices.EqualFunc(a.Heads(), b.Heads(), func(x, y *storage.Manifest) bool {
+		return x.Version == y.Version && x.Modified.Equal(y.Modified) && maps.Equal(x.Clock, y.Clock)
+	})
+}
+
+// current returns the manifest a write to key replaces: the local one or,
+// failing that, the one the replicas agree on. It is nil for a new file.
+func (s *FileServer) current(key string) *storage.Manifest {
+	if m, err := s.storage.ReadManifest(key); err == nil {
+		return m
+	}
+	if vote, err := s.lookup(key, ""); err == nil {
+		return vote.manifest
+	}
+
+	return nil
+}
+
+// nextClock returns the version vector for a write to key by this node,
+// which has seen every version the write replaces.
+func (s *FileServer) nextClock(prev *storage.Manifest) storage.VersionVector {
+	var clock storage.VersionVector
+	if prev != nil {
+		clock = prev.MergedClock()
+	}
+
+	return clock.Increment(s.id)
+}
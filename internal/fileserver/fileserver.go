@@ -2,66 +2,223 @@ package fileserver
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"slices"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/AaravShirvoikar/scatterfs/crypto"
 	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/placement"
 	"github.com/AaravShirvoikar/scatterfs/storage"
 )
 
+const defaultReplicationFactor = 3
+
+type FileServerOpts struct {
+	// ID identifies this node on the placement ring. It must match the ID
+	// peers see for it, so with an authenticating handshake it should be
+	// the node identity's ID, and with the default one the transport's
+	// NodeID. Defaults to the transport address.
+	ID        string
+	Transport p2p.Transport
+	// Storage is the backend files are kept on, such as a storage.Storage
+	// on disk or a storage.PackBackend.
+	Storage           storage.Backend
+	BootstrapNodes    []string
+	EncKey            []byte
+	ReplicationFactor int
+	// WriteQuorum is how many replicas must acknowledge a Store before it
+	// succeeds. Defaults to a majority of ReplicationFactor.
+	WriteQuorum int
+	// ReadQuorum is how many replicas must return the same manifest before
+	// Get serves a file. Defaults to 1.
+	ReadQuorum int
+	// RepairInterval is how often the server compares its files with each
+	// peer and repairs replicas that are missing or stale.
+	RepairInterval time.Duration
+	// ScrubInterval is how often the server reads back everything it
+	// stores to find corrupt blobs, and ScrubRate how many bytes per second
+	// it reads while doing so.
+	ScrubInterval time.Duration
+	ScrubRate     int64
+	// VersionRetention bounds the history kept for versioned files.
+	// Defaults to the last 10 versions.
+	VersionRetention storage.RetentionPolicy
+	// TombstoneGracePeriod is how long a deleted file's tombstone is kept.
+	// A replica down for longer can bring the file back.
+	TombstoneGracePeriod time.Duration
+	// ConflictMode is how replicas settle concurrent writes to a file.
+	// Defaults to LastWriterWins.
+	ConflictMode ConflictMode
+	// ProbeInterval is how often the membership protocol probes a member,
+	// and SuspectTimeout how long a member that failed a probe has to
+	// answer before it is declared dead and taken off the ring.
+	ProbeInterval  time.Duration
+	SuspectTimeout time.Duration
+}
+
 type FileServer struct {
-	transport      p2p.Transport
-	storage        *storage.Storage
-	bootstrapNodes []string
-	encKey         []byte
-	peerLock       sync.Mutex
-	peers          map[string]p2p.Peer
-	quitChan       chan struct{}
+	id                string
+	transport         p2p.Transport
+	storage           *storage.Store
+	bootstrapNodes    []string
+	encKey            []byte
+	replicationFactor int
+	writeQuorum       int
+	readQuorum        int
+	repairInterval    time.Duration
+	scrubInterval     time.Duration
+	scrubRate         int64
+	versionRetention  storage.RetentionPolicy
+	tombstoneGrace    time.Duration
+	conflictMode      ConflictMode
+	ring              *placement.Ring
+	members           *p2p.Membership
+	peerLock          sync.Mutex
+	peers             map[string]p2p.Peer
+	gcLock            sync.RWMutex
+	manifestLock      sync.Mutex
+	flagLock          sync.Mutex
+	flagged           map[string]int
+	pendingLock       sync.Mutex
+	pending           map[uint64]*request
+	metrics           metrics
+	scrubbing         sync.Mutex
+	scrubLock         sync.Mutex
+	scrubReport       ScrubReport
+	quitChan          chan struct{}
+	stopOnce          sync.Once
 }
 
-func NewFileServer(transport p2p.Transport, storage *storage.Storage, nodes []string, encKey []byte) *FileServer {
-	return &FileServer{
-		transport:      transport,
-		storage:        storage,
-		bootstrapNodes: nodes,
-		encKey:         encKey,
-		peers:          make(map[string]p2p.Peer),
-		quitChan:       make(chan struct{}),
+func NewFileServer(opts FileServerOpts) *FileServer {
+	if opts.ID == "" {
+		opts.ID = opts.Transport.Addr()
+	}
+	if opts.ReplicationFactor <= 0 {
+		opts.ReplicationFactor = defaultReplicationFactor
+	}
+	if opts.WriteQuorum <= 0 {
+		opts.WriteQuorum = majority(opts.ReplicationFactor)
+	}
+	if opts.ReadQuorum <= 0 {
+		opts.ReadQuorum = defaultReadQuorum
+	}
+	if opts.RepairInterval <= 0 {
+		opts.RepairInterval = defaultRepairInterval
+	}
+	if opts.ScrubInterval <= 0 {
+		opts.ScrubInterval = defaultScrubInterval
+	}
+	if opts.ScrubRate <= 0 {
+		opts.ScrubRate = defaultScrubRate
+	}
+	if opts.VersionRetention == (storage.RetentionPolicy{}) {
+		opts.VersionRetention = defaultVersionRetention
+	}
+	if opts.TombstoneGracePeriod <= 0 {
+		opts.TombstoneGracePeriod = defaultTombstoneGracePeriod
+	}
+
+	ring := placement.NewRing(placement.DefaultVirtualNodes)
+	ring.Add(opts.ID)
+
+	s := &FileServer{
+		id:                opts.ID,
+		transport:         opts.Transport,
+		storage:           storage.NewStore(opts.Storage),
+		bootstrapNodes:    opts.BootstrapNodes,
+		encKey:            opts.EncKey,
+		replicationFactor: opts.ReplicationFactor,
+		writeQuorum:       opts.WriteQuorum,
+		readQuorum:        opts.ReadQuorum,
+		repairInterval:    opts.RepairInterval,
+		scrubInterval:     opts.ScrubInterval,
+		scrubRate:         opts.ScrubRate,
+		versionRetention:  opts.VersionRetention,
+		tombstoneGrace:    opts.TombstoneGracePeriod,
+		conflictMode:      opts.ConflictMode,
+		ring:              ring,
+		peers:             make(map[string]p2p.Peer),
+		pending:           make(map[uint64]*request),
+		flagged:           make(map[string]int),
+		quitChan:          make(chan struct{}),
 	}
+	s.members = p2p.NewMembership(p2p.MembershipOpts{
+		ID:             opts.ID,
+		Addr:           opts.Transport.Addr(),
+		Send:           s.sendGossip,
+		PeerAddr:       s.peerAddr,
+		OnJoin:         s.onMemberJoin,
+		OnLeave:        s.onMemberLeave,
+		ProbeInterval:  opts.ProbeInterval,
+		SuspectTimeout: opts.SuspectTimeout,
+	})
+
+	return s
 }
 
 type Message struct {
 	Payload any
 }
 
+// MessageGet asks for key's current manifest, or for an archived one if
+// Version is set.
 type MessageGet struct {
-	Key string
+	ID      uint64
+	Key     string
+	Version string
+}
+
+type MessageGetChunks struct {
+	ID     uint64
+	Hashes []string
 }
 
+type MessageHave struct {
+	ID     uint64
+	Hashes []string
+}
+
+// MessageStore carries a file's manifest. The chunks listed in Chunks, which
+// the receiver reported missing, follow in that order on the stream.
 type MessageStore struct {
-	Key  string
-	Size int64
+	ID       uint64
+	Key      string
+	Manifest *storage.Manifest
+	Chunks   []string
+	StreamID uint32
 }
 
-type MessageRemove struct {
-	Key string
+type MessageList struct {
+	ID     uint64
+	Prefix string
 }
 
-func (s *FileServer) broadcast(msg *Message) error {
+// FileInfo is a file as seen across the cluster: the newest version any node
+// reported, and every node holding a copy.
+type FileInfo struct {
+	storage.KeyInfo
+	Nodes []string
+}
+
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
 	buff := new(bytes.Buffer)
 	if err := gob.NewEncoder(buff).Encode(msg); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buff.Bytes()); err != nil {
+	return peer.Send(buff.Bytes())
+}
+
+func (s *FileServer) broadcast(msg *Message) error {
+	for _, peer := range s.peerList() {
+		if err := s.send(peer, msg); err != nil {
 			return err
 		}
 	}
@@ -69,139 +226,374 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.storage.Exists(key) {
-		log.Printf("[%s] serving file %s locally", s.transport.Addr(), key)
-		_, r, err := s.storage.Read(key)
-		if err != nil {
-			return nil, err
+func (s *FileServer) peer(id string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peer, ok := s.peers[id]
+	if !ok {
+		return nil, fmt.Errorf("peer %s not found", id)
+	}
+
+	return peer, nil
+}
+
+// replicaPeers splits the connected peers into the replicas of key, in ring
+// preference order, and everyone else.
+func (s *FileServer) replicaPeers(key string) ([]p2p.Peer, []p2p.Peer) {
+	owners := s.ring.Owners(key, s.replicationFactor)
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	replicas := []p2p.Peer{}
+	isOwner := make(map[string]bool, len(owners))
+	for _, owner := range owners {
+		isOwner[owner] = true
+		if peer, ok := s.peers[owner]; ok {
+			replicas = append(replicas, peer)
 		}
+	}
 
-		decBuff := new(bytes.Buffer)
-		_, err = crypto.CopyDecrypt(s.encKey, r, decBuff)
-		return decBuff, err
+	others := []p2p.Peer{}
+	for id, peer := range s.peers {
+		if !isOwner[id] {
+			others = append(others, peer)
+		}
 	}
 
-	log.Printf("[%s] does not have file %s locally, fetching from network", s.transport.Addr(), key)
+	return replicas, others
+}
 
-	msg := Message{
-		Payload: MessageGet{
-			Key: key,
-		},
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	return peers
+}
+
+// lookup finds the manifest of key that ReadQuorum replicas, counting this
+// node if it is one, agree on. Only the replicas vote, as copies left on
+// other nodes may be stale; those nodes still serve chunks, which are
+// verified against their hashes. An archived version is taken from the
+// first node that has it, replica or not, as versions never change.
+func (s *FileServer) lookup(key, version string) (*manifestVote, error) {
+	votes := newManifestVotes(s.quorumSize(key, s.readQuorum))
+
+	var m *storage.Manifest
+	var err error
+	if version == "" {
+		m, err = s.storage.ReadManifest(key)
+	} else {
+		votes.need = 1
+		m, err = s.storage.ReadVersion(key, version)
+	}
+
+	switch {
+	case err == nil && version == "" && !slices.Contains(s.ring.Owners(key, s.replicationFactor), s.id):
+		log.Printf("[%s] has file %s locally but is not a replica, asking replicas", s.transport.Addr(), key)
+	case err == nil:
+		if v := votes.add("", m); v.count() >= votes.need {
+			return v, nil
+		}
+		log.Printf("[%s] has file %s locally, asking replicas for read quorum", s.transport.Addr(), key)
+	case errors.Is(err, fs.ErrNotExist):
+		log.Printf("[%s] does not have file %s locally, fetching from network", s.transport.Addr(), key)
+	default:
 		return nil, err
 	}
 
-	timeout := time.After(time.Second * 3)
-	done := make(chan bool)
+	owners, others := s.replicaPeers(key)
+	vote, err := s.findManifest(key, version, owners, votes)
+	if err != nil && version != "" && len(others) > 0 {
+		log.Printf("[%s] replicas of %s do not have version %s, asking remaining peers", s.transport.Addr(), key, version)
+		vote, err = s.findManifest(key, version, others, votes)
+	}
 
-	for _, peer := range s.peers {
-		go func(peer p2p.Peer) {
-			var fileSize int64
-			if err := binary.Read(peer, binary.LittleEndian, &fileSize); err != nil {
-				return
-			}
+	return vote, err
+}
 
-			if fileSize == -1 {
-				peer.CloseStream()
-				return
-			}
+type getOptions struct {
+	version   string
+	conflicts bool
+}
 
-			encBuff := new(bytes.Buffer)
-			if _, err := crypto.CopyEncrypt(s.encKey, io.LimitReader(peer, fileSize), encBuff); err != nil {
-				return
-			}
+// GetOption selects what Get reads.
+type GetOption func(*getOptions)
 
-			if _, err := s.storage.Write(key, encBuff); err != nil {
-				return
-			}
+// WithVersion makes Get read the given version of the file rather than the
+// current one.
+func WithVersion(id string) GetOption {
+	return func(o *getOptions) {
+		o.version = id
+	}
+}
 
-			log.Printf("[%s] received %d bytes over the network from %s", s.transport.Addr(), fileSize, peer.RemoteAddr())
+// WithConflicts makes Get fail with a *ConflictError listing the siblings
+// when the file holds concurrently written versions, rather than read the
+// one that sorts first.
+func WithConflicts() GetOption {
+	return func(o *getOptions) {
+		o.conflicts = true
+	}
+}
 
-			peer.CloseStream()
-			done <- true
-		}(peer)
+// Get returns key's contents once ReadQuorum replicas agree on its manifest.
+// Chunks missing locally are streamed from one of the agreeing peers.
+func (s *FileServer) Get(key string, opts ...GetOption) (io.ReadCloser, error) {
+	o := getOptions{}
+	for _, opt := range opts {
+		opt(&o)
 	}
 
-	select {
-	case <-done:
-		_, r, err := s.storage.Read(key)
-		if err != nil {
-			return nil, err
+	vote, err := s.lookup(key, o.version)
+	if errors.Is(err, storage.ErrNotManifest) {
+		log.Printf("[%s] serving file %s from a blob stored before chunking", s.transport.Addr(), key)
+		return s.readLegacy(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if o.conflicts && len(vote.manifest.Siblings) > 0 {
+		return nil, newConflictError(vote.manifest)
+	}
+
+	m := vote.manifest.Heads()[0]
+	if m.Deleted {
+		return nil, fmt.Errorf("file %s: %w", key, ErrDeleted)
+	}
+
+	missing := s.missingChunks(m.Hashes())
+	if len(missing) == 0 {
+		log.Printf("[%s] serving file %s locally", s.transport.Addr(), key)
+		return s.newFileReader(m, vote.peers), nil
+	}
+	if len(vote.peers) == 0 {
+		return nil, fmt.Errorf("file %s is missing %d chunks locally", key, len(missing))
+	}
+
+	from := s.preferHealthy(vote.peers)[0]
+	peer, err := s.peer(from)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := s.call(peer, func(id uint64) any {
+		return MessageGetChunks{ID: id, Hashes: missing}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[%s] streaming file %s from %s, %d of %d chunks remote", s.transport.Addr(), key, from, len(missing), len(m.Chunks))
+
+	r := s.newFileReader(m, vote.peers)
+	r.streamFrom(from, missing, chunks.stream)
+
+	return r, nil
+}
+
+// Stat returns key's metadata from the manifest ReadQuorum replicas agree on.
+func (s *FileServer) Stat(key string) (storage.Metadata, error) {
+	vote, err := s.lookup(key, "")
+	if err != nil {
+		return storage.Metadata{}, err
+	}
+	if vote.manifest.Deleted {
+		return storage.Metadata{}, fmt.Errorf("file %s: %w", key, ErrDeleted)
+	}
+
+	return vote.manifest.Metadata(), nil
+}
+
+type storeOptions struct {
+	contentType string
+	attributes  map[string]string
+	versioned   bool
+}
+
+// StoreOption sets metadata recorded with a stored file.
+type StoreOption func(*storeOptions)
+
+func WithContentType(contentType string) StoreOption {
+	return func(o *storeOptions) {
+		o.contentType = contentType
+	}
+}
+
+// WithAttribute records a custom key/value attribute with the file.
+func WithAttribute(name, value string) StoreOption {
+	return func(o *storeOptions) {
+		if o.attributes == nil {
+			o.attributes = make(map[string]string)
 		}
+		o.attributes[name] = value
+	}
+}
 
-		decBuff := new(bytes.Buffer)
-		_, err = crypto.CopyDecrypt(s.encKey, r, decBuff)
-		return decBuff, err
-	case <-timeout:
-		return nil, fmt.Errorf("server timed out while fetching file %s from network", key)
+// WithVersioning makes the file versioned, so that it and every later
+// version stored under its key are kept in its history.
+func WithVersioning() StoreOption {
+	return func(o *storeOptions) {
+		o.versioned = true
 	}
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	fileBuff := new(bytes.Buffer)
-	tee := io.TeeReader(r, fileBuff)
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
 
-	encBuff := new(bytes.Buffer)
-	if _, err := crypto.CopyEncrypt(s.encKey, tee, encBuff); err != nil {
+// Store writes the file to the replicas the placement ring picks for key
+// and returns once WriteQuorum of them have acknowledged it; replication to
+// the rest finishes in the background. The chunks are always written locally
+// first so they can be streamed to the replicas; if this node is not a
+// replica they are left for the chunk garbage collector.
+func (s *FileServer) Store(key string, r io.Reader, opts ...StoreOption) error {
+	if err := storage.ValidateKey(key); err != nil {
 		return err
 	}
 
-	size, err := s.storage.Write(key, encBuff)
+	o := storeOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	m, err := s.writeChunks(r)
 	if err != nil {
 		return err
 	}
+	m.Key = key
+	m.Modified = time.Now()
+	m.Created = m.Modified
+	m.Version = storage.NewVersionID(m.Modified)
+	m.Versioned = o.versioned
+	m.Owner = s.id
+	m.ContentType = o.contentType
+	m.Attributes = o.attributes
+	prev := s.current(key)
+	if prev != nil {
+		if !prev.Deleted {
+			m.Created = prev.Created
+		}
+		m.Versioned = m.Versioned || prev.Versioned
+	}
+	m.Clock = s.nextClock(prev)
 
-	log.Printf("[%s] wrote %d bytes to storage", s.transport.Addr(), size)
+	return s.put(key, m)
+}
+
+// put writes m as key's current manifest on the replicas of key, returning
+// once WriteQuorum of them have acknowledged it. The caller holds gcLock and
+// has stored m's chunks locally.
+func (s *FileServer) put(key string, m *storage.Manifest) error {
+	owners := s.ring.Owners(key, s.replicationFactor)
+	need := min(s.writeQuorum, len(owners))
+
+	acks := 0
+	var errs []error
+	peers := []p2p.Peer{}
+	for _, owner := range owners {
+		if owner == s.id {
+			if err := s.writeManifest(key, m); err != nil {
+				errs = append(errs, fmt.Errorf("local: %w", err))
+				continue
+			}
+			acks++
+			log.Printf("[%s] stored file %s locally, %d bytes in %d chunks", s.transport.Addr(), key, m.Size, len(m.Chunks))
+			continue
+		}
 
-	fileSize := fileBuff.Len()
-	msg := Message{
-		Payload: MessageStore{
-			Key:  key,
-			Size: int64(fileSize),
-		},
+		peer, err := s.peer(owner)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		peers = append(peers, peer)
 	}
 
-	if err := s.broadcast(&msg); err != nil {
-		return err
+	errChan := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer p2p.Peer) {
+			if err := s.replicate(peer, key, m); err != nil {
+				errChan <- fmt.Errorf("peer %s: %w", peer.ID(), err)
+				return
+			}
+			errChan <- nil
+		}(peer)
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	pending := len(peers)
+	for ; pending > 0 && acks < need; pending-- {
+		if err := <-errChan; err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		acks++
+	}
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	if pending > 0 {
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if err := <-errChan; err != nil {
+					log.Printf("[%s] failed to replicate file %s: %v", s.transport.Addr(), key, err)
+				}
+			}
+		}(pending)
 	}
-	mw := io.MultiWriter(peers...)
 
-	mw.Write([]byte{p2p.IncomingStream})
-	_, err = io.Copy(mw, fileBuff)
-	if err != nil {
-		return err
+	if acks < need {
+		return fmt.Errorf("write quorum not met for file %s: %d of %d replicas acknowledged: %w", key, acks, need, errors.Join(errs...))
+	}
+
+	if len(errs) > 0 {
+		log.Printf("[%s] stored file %s with quorum, some replicas failed: %v", s.transport.Addr(), key, errors.Join(errs...))
 	}
 
 	return nil
 }
 
+// Remove deletes key across the cluster by storing a tombstone in its place
+// on the replicas, returning once WriteQuorum of them have it. Replicas that
+// miss it, such as ones that are down, learn of the delete through
+// anti-entropy, which gets TombstoneGracePeriod to reach them before the
+// tombstone is collected.
 func (s *FileServer) Remove(key string) error {
-	if s.storage.Exists(key) {
-		log.Printf("[%s] removed file %s", s.transport.Addr(), key)
-		if err := s.storage.Delete(key); err != nil {
+	if err := storage.ValidateKey(key); err != nil {
+		return err
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	m := &storage.Manifest{Key: key, Deleted: true, Modified: time.Now(), Owner: s.id}
+	m.Created = m.Modified
+	m.Version = storage.NewVersionID(m.Modified)
+	prev := s.current(key)
+	if prev != nil {
+		m.Versioned = prev.Versioned
+	}
+	m.Clock = s.nextClock(prev)
+
+	// A copy held outside the replicas is dropped here, as nothing else
+	// would reach it.
+	if s.storage.Exists(key) && !slices.Contains(s.ring.Owners(key, s.replicationFactor), s.id) {
+		if err := s.writeManifest(key, m); err != nil {
 			return err
 		}
-	} else {
-		log.Printf("[%s] does not have file %s", s.transport.Addr(), key)
 	}
 
-	msg := Message{
-		Payload: MessageRemove{
-			Key: key,
-		},
-	}
+	log.Printf("[%s] removing file %s", s.transport.Addr(), key)
 
-	return s.broadcast(&msg)
+	return s.put(key, m)
 }
 
 func (s *FileServer) RemoveLocal(key string) error {
@@ -215,6 +607,52 @@ func (s *FileServer) RemoveLocal(key string) error {
 	return nil
 }
 
+// List returns the files stored anywhere in the cluster whose keys start
+// with prefix, sorted by key. Peers that fail to answer are reported in the
+// error, alongside whatever the rest of the cluster returned.
+func (s *FileServer) List(prefix string) ([]FileInfo, error) {
+	local, err := s.storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]*FileInfo)
+	merge := func(node string, infos []storage.KeyInfo) {
+		for _, info := range infos {
+			f, ok := files[info.Key]
+			if !ok {
+				files[info.Key] = &FileInfo{KeyInfo: info, Nodes: []string{node}}
+				continue
+			}
+			if info.Modified.After(f.Modified) {
+				f.KeyInfo = info
+			}
+			f.Nodes = append(f.Nodes, node)
+		}
+	}
+	merge(s.id, local)
+
+	resps, errs := s.gather(func(id uint64) any {
+		return MessageList{ID: id, Prefix: prefix}
+	})
+	for _, resp := range resps {
+		merge(resp.from, resp.Keys)
+	}
+
+	list := make([]FileInfo, 0, len(files))
+	for _, f := range files {
+		sort.Strings(f.Nodes)
+		list = append(list, *f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+
+	if len(errs) > 0 {
+		return list, fmt.Errorf("failed to list files on some peers: %w", errors.Join(errs...))
+	}
+
+	return list, nil
+}
+
 func (s *FileServer) loop() {
 	defer func() {
 		log.Printf("[%s] file server stopped", s.transport.Addr())
@@ -230,9 +668,11 @@ func (s *FileServer) loop() {
 				continue
 			}
 
-			if err := s.handleMessage(msg.From, &m); err != nil {
-				log.Println(err)
-			}
+			go func() {
+				if err := s.handleMessage(msg.From, &m); err != nil {
+					log.Println(err)
+				}
+			}()
 		case <-s.quitChan:
 			return
 		}
@@ -243,141 +683,225 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	switch v := msg.Payload.(type) {
 	case MessageGet:
 		return s.handleMessageGet(from, v)
+	case MessageGossip:
+		return s.members.Handle(from, v.Payload)
+	case MessageGetChunks:
+		return s.handleMessageGetChunks(from, v)
+	case MessageHave:
+		return s.handleMessageHave(from, v)
 	case MessageStore:
 		return s.handleMessageStore(from, v)
-	case MessageRemove:
-		return s.handleMessageRemove(from, v)
+	case MessageList:
+		return s.handleMessageList(from, v)
+	case MessageVersions:
+		return s.handleMessageVersions(from, v)
+	case MessageSyncTree:
+		return s.handleMessageSyncTree(from, v)
+	case MessageSyncKeys:
+		return s.handleMessageSyncKeys(from, v)
+	case MessageResponse:
+		return s.handleMessageResponse(from, v)
 	}
 
 	return nil
 }
 
 func (s *FileServer) handleMessageGet(from string, msg MessageGet) error {
+	if msg.Version != "" {
+		return s.handleMessageGetVersion(from, msg)
+	}
+
 	if !s.storage.Exists(msg.Key) {
-		peer, ok := s.peers[from]
-		if !ok {
-			return fmt.Errorf("peer not found")
-		}
+		log.Printf("[%s] does not have file %s", s.transport.Addr(), msg.Key)
+		return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusNotFound})
+	}
 
-		fileSize := -1
-		peer.Send([]byte{p2p.IncomingStream})
-		binary.Write(peer, binary.LittleEndian, int64(fileSize))
-		return fmt.Errorf("[%s] does not have file %s", s.transport.Addr(), msg.Key)
+	m, err := s.storage.ReadManifest(msg.Key)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
 	}
 
-	log.Printf("[%s] has file %s, serving over the network", s.transport.Addr(), msg.Key)
+	log.Printf("[%s] has file %s, serving manifest to %s", s.transport.Addr(), msg.Key, from)
 
-	_, r, err := s.storage.Read(msg.Key)
-	if err != nil {
-		return err
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusFound, Manifest: m})
+}
+
+func (s *FileServer) handleMessageGetChunks(from string, msg MessageGetChunks) error {
+	if missing := s.missingChunks(msg.Hashes); len(missing) > 0 {
+		return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusNotFound, Missing: missing})
 	}
 
-	decBuff := new(bytes.Buffer)
-	_, err = crypto.CopyDecrypt(s.encKey, r, decBuff)
+	peer, err := s.peer(from)
 	if err != nil {
 		return err
 	}
 
-	fileSize := decBuff.Len()
-
-	if rc, ok := r.(io.ReadCloser); ok {
-		defer rc.Close()
+	stream, err := peer.OpenStream()
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer not found")
+	resp := MessageResponse{
+		ID:       msg.ID,
+		Status:   StatusFound,
+		StreamID: stream.ID(),
+	}
+	if err := s.send(peer, &Message{Payload: resp}); err != nil {
+		stream.Reset()
+		return err
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, int64(fileSize))
-	n, err := io.Copy(peer, decBuff)
-	if err != nil {
+	if err := s.sendChunks(stream, msg.Hashes); err != nil {
+		stream.Reset()
 		return err
 	}
 
-	log.Printf("[%s] wrote %d bytes over the network to %s", s.transport.Addr(), n, from)
+	log.Printf("[%s] sent %d chunks over the network to %s", s.transport.Addr(), len(msg.Hashes), from)
 
-	return nil
+	return stream.Close()
 }
 
-func (s *FileServer) handleMessageStore(from string, msg MessageStore) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer not found")
-	}
+func (s *FileServer) handleMessageHave(from string, msg MessageHave) error {
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK, Missing: s.missingChunks(msg.Hashes)})
+}
 
-	encBuff := new(bytes.Buffer)
-	_, err := crypto.CopyEncrypt(s.encKey, io.LimitReader(peer, msg.Size), encBuff)
+func (s *FileServer) handleMessageStore(from string, msg MessageStore) error {
+	peer, err := s.peer(from)
 	if err != nil {
 		return err
 	}
 
-	n, err := s.storage.Write(msg.Key, encBuff)
+	stream, err := peer.AcceptStream(msg.StreamID)
 	if err != nil {
-		return err
+		return s.respondErr(from, msg.ID, err)
 	}
+	defer stream.Close()
 
-	log.Printf("[%s] received %d bytes and wrote %d bytes to storage", s.transport.Addr(), msg.Size, n)
+	if msg.Manifest == nil {
+		return s.respondErr(from, msg.ID, fmt.Errorf("store of %s carries no manifest", msg.Key))
+	}
+	msg.Manifest.Key = msg.Key
+	if err := msg.Manifest.Validate(); err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
 
-	peer.CloseStream()
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
 
-	return nil
-}
+	if err := s.receiveChunks(stream, msg.Manifest, msg.Chunks); err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
 
-func (s *FileServer) handleMessageRemove(from string, msg MessageRemove) error {
-	log.Printf("[%s] received file delete request from %s", s.transport.Addr(), from)
-	if s.storage.Exists(msg.Key) {
-		log.Printf("[%s] removed file %s", s.transport.Addr(), msg.Key)
-		return s.storage.Delete(msg.Key)
+	if missing := s.missingChunks(msg.Manifest.Hashes()); len(missing) > 0 {
+		return s.respondErr(from, msg.ID, fmt.Errorf("file %s is missing %d chunks", msg.Key, len(missing)))
 	}
 
-	log.Printf("[%s] does not have file %s", s.transport.Addr(), msg.Key)
+	if err := s.writeManifest(msg.Key, msg.Manifest); err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
 
-	return nil
+	log.Printf("[%s] received file %s from %s, %d new chunks", s.transport.Addr(), msg.Key, from, len(msg.Chunks))
+
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK})
 }
 
-func (s *FileServer) bootstrapNetwork() error {
-	for _, addr := range s.bootstrapNodes {
-		log.Printf("[%s] attempting to connect to %s", s.transport.Addr(), addr)
-		go func(addr string) {
-			if err := s.transport.Dial(addr); err != nil {
-				fmt.Println("dial error:", err)
-			}
-		}(addr)
+func (s *FileServer) handleMessageList(from string, msg MessageList) error {
+	infos, err := s.storage.List(msg.Prefix)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
 	}
 
-	return nil
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK, Keys: infos})
+}
+
+// bootstrapNetwork keeps this node connected to the bootstrap nodes. Ones
+// not reachable yet are retried in the background, so nodes can start in
+// any order.
+func (s *FileServer) bootstrapNetwork() {
+	for _, addr := range s.bootstrapNodes {
+		log.Printf("[%s] connecting to %s", s.transport.Addr(), addr)
+		s.transport.Connect(addr)
+	}
 }
 
 func (s *FileServer) OnPeer(peer p2p.Peer) error {
 	s.peerLock.Lock()
-	s.peers[peer.RemoteAddr().String()] = peer
+	s.peers[peer.ID()] = peer
 	s.peerLock.Unlock()
 
-	log.Printf("[%s] connected to remote %s", s.transport.Addr(), peer.RemoteAddr())
+	log.Printf("[%s] connected to remote %s (%s)", s.transport.Addr(), peer.ID(), peer.ListenAddr())
+
+	// Swapping member lists with every new peer is how a node joining
+	// through one seed learns the rest of the cluster.
+	go func() {
+		if err := s.members.Join(peer.ID()); err != nil {
+			log.Printf("[%s] failed to exchange members with %s: %v", s.transport.Addr(), peer.ID(), err)
+		}
+	}()
 
 	return nil
 }
 
+// OnPeerDisconnect forgets a peer whose connection was lost, so requests
+// stop going to it. A peer that has already reconnected is left alone. It
+// stays on the placement ring until the membership protocol finds it dead.
+func (s *FileServer) OnPeerDisconnect(peer p2p.Peer) {
+	s.peerLock.Lock()
+	current, ok := s.peers[peer.ID()]
+	gone := ok && current == peer
+	if gone {
+		delete(s.peers, peer.ID())
+	}
+	s.peerLock.Unlock()
+
+	if gone {
+		log.Printf("[%s] disconnected from remote %s (%s)", s.transport.Addr(), peer.ID(), peer.ListenAddr())
+	}
+}
+
 func (s *FileServer) Start() error {
+	n, err := s.storage.Recover()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("[%s] removed %d temp files left by interrupted writes", s.transport.Addr(), n)
+	}
+
 	if err := s.transport.ListenAndAccept(); err != nil {
 		return err
 	}
 
 	s.bootstrapNetwork()
 
+	go s.members.Start()
+	go s.gcLoop()
+	go s.repairLoop()
+	go s.scrubLoop()
+
 	s.loop()
 
 	return nil
 }
 
+// Stop tells the cluster this node is leaving and shuts it down.
 func (s *FileServer) Stop() {
-	close(s.quitChan)
+	s.stopOnce.Do(func() {
+		s.members.Leave()
+		s.members.Stop()
+		close(s.quitChan)
+	})
 }
 
 func init() {
 	gob.Register(MessageGet{})
+	gob.Register(MessageGetChunks{})
+	gob.Register(MessageHave{})
 	gob.Register(MessageStore{})
-	gob.Register(MessageRemove{})
+	gob.Register(MessageList{})
+	gob.Register(MessageVersions{})
+	gob.Register(MessageSyncTree{})
+	gob.Register(MessageSyncKeys{})
+	gob.Register(MessageGossip{})
+	gob.Register(MessageResponse{})
 }
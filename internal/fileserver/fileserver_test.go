@@ -0,0 +1,1008 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/crypto"
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func freeAddr(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func newTestServer(t testing.TB, opts FileServerOpts) *FileServer {
+	id, err := p2p.NewIdentity()
+	assert.Nil(t, err)
+
+	return startTestServer(t, id, opts)
+}
+
+// startTestServer starts a server for identity id. Storage and EncKey are
+// created unless set in opts, so a server can be restarted over its old data.
+func startTestServer(t testing.TB, id *p2p.Identity, opts FileServerOpts) *FileServer {
+	opts.ID = id.NodeID()
+
+	return serveTestServer(t, p2p.NewAuthHandshakeFunc(id, nil), opts)
+}
+
+// serveTestServer starts a server on a free address using handshake.
+func serveTestServer(t testing.TB, handshake p2p.HandshakeFunc, opts FileServerOpts) *FileServer {
+	addr := freeAddr(t)
+
+	tr := p2p.NewTCPTransport(addr, handshake, p2p.DefaultDecodeFunc, nil)
+	if opts.Storage == nil {
+		opts.Storage = storage.NewStorage(t.TempDir(), storage.DefaultPathTransformFunc)
+	}
+	if opts.EncKey == nil {
+		opts.EncKey = crypto.NewAESKey()
+	}
+	opts.Transport = tr
+
+	fs := NewFileServer(opts)
+	tr.OnPeer = fs.OnPeer
+	tr.OnPeerDisconnect = fs.OnPeerDisconnect
+
+	go fs.Start()
+	t.Cleanup(fs.Stop)
+
+	// A bare connection fails the handshake, so probing does not add a peer.
+	assert.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+
+	return fs
+}
+
+// newCluster starts n fully connected servers, each one dialing all of the
+// servers started before it.
+func newCluster(t testing.TB, n int, opts FileServerOpts) []*FileServer {
+	servers := []*FileServer{}
+	addrs := []string{}
+
+	for i := 0; i < n; i++ {
+		opts.BootstrapNodes = append([]string{}, addrs...)
+		fs := newTestServer(t, opts)
+		servers = append(servers, fs)
+		addrs = append(addrs, fs.transport.Addr())
+	}
+
+	for _, fs := range servers {
+		waitForPeers(t, fs, n-1)
+	}
+
+	return servers
+}
+
+// waitForPeers waits until fs is connected to n peers and has them all on
+// its placement ring.
+func waitForPeers(t testing.TB, fs *FileServer, n int) {
+	assert.Eventually(t, func() bool {
+		return len(fs.peerList()) == n && len(fs.ring.Nodes()) == n+1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConcurrentGet(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	files := map[string][]byte{}
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("file-%d", i)
+		files[key] = bytes.Repeat([]byte{byte(i)}, 100_000+i)
+
+		assert.Nil(t, a.Store(key, bytes.NewReader(files[key])))
+		assert.Nil(t, b.RemoveLocal(key))
+	}
+
+	var wg sync.WaitGroup
+	for key, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			r, err := b.Get(key)
+			if !assert.Nil(t, err) {
+				return
+			}
+
+			defer r.Close()
+
+			got, err := io.ReadAll(r)
+			assert.Nil(t, err)
+			assert.Equal(t, data, got)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetMissingFileReportsPeers(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, b, 1)
+
+	_, err := b.Get("missing")
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestStoreReplicatesOnlyMissingChunks(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+
+	data := make([]byte, 2<<20)
+	rand.Read(data)
+	assert.Nil(t, a.Store("original", bytes.NewReader(data)))
+
+	before, err := b.storage.Chunks()
+	assert.Nil(t, err)
+
+	edited := append(bytes.Clone(data[:1<<20]), []byte("a small edit")...)
+	edited = append(edited, data[1<<20:]...)
+	assert.Nil(t, a.Store("edited", bytes.NewReader(edited)))
+
+	after, err := b.storage.Chunks()
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, len(after)-len(before), 2)
+
+	r, err := b.Get("edited")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, edited, got)
+}
+
+func TestGetStreamsRemoteChunks(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, b, 1)
+
+	r, err := b.Get("file")
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	r.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.False(t, b.storage.Exists("file"))
+}
+
+func TestStorePlacesReplicasOnRing(t *testing.T) {
+	servers := newCluster(t, 4, FileServerOpts{ReplicationFactor: 2})
+
+	data := []byte("placed data")
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("file-%d", i)
+		assert.Nil(t, servers[0].Store(key, bytes.NewReader(data)))
+
+		owners := servers[0].ring.Owners(key, 2)
+		holders := []string{}
+		for _, fs := range servers {
+			if fs.storage.Exists(key) {
+				holders = append(holders, fs.id)
+			}
+		}
+		assert.ElementsMatch(t, owners, holders)
+
+		for _, fs := range servers {
+			r, err := fs.Get(key)
+			if !assert.Nil(t, err) {
+				continue
+			}
+			got, err := io.ReadAll(r)
+			r.Close()
+			assert.Nil(t, err)
+			assert.Equal(t, data, got)
+		}
+	}
+}
+
+func TestStoreWriteQuorum(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{WriteQuorum: 3})
+	a, c := servers[0], servers[2]
+
+	// Rooting c's storage at a regular file makes every write to it fail.
+	broken := filepath.Join(t.TempDir(), "broken")
+	assert.Nil(t, os.WriteFile(broken, nil, 0o644))
+	c.storage = storage.NewStore(storage.NewStorage(broken, storage.DefaultPathTransformFunc))
+
+	err := a.Store("file", bytes.NewReader([]byte("quorum data")))
+	assert.ErrorContains(t, err, "write quorum not met")
+	assert.ErrorContains(t, err, c.id)
+
+	a.writeQuorum = 2
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("quorum data"))))
+}
+
+func TestGetReadQuorum(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{WriteQuorum: 3})
+	a, c := servers[0], servers[2]
+
+	data := []byte("agreed data")
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+
+	stale, err := c.writeChunks(bytes.NewReader([]byte("stale data")))
+	assert.Nil(t, err)
+	assert.Nil(t, c.storage.WriteManifest("file", stale))
+
+	c.readQuorum = 3
+	_, err = c.Get("file")
+	assert.ErrorContains(t, err, "read quorum not met")
+
+	c.readQuorum = 2
+	r, err := c.Get("file")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestReadQuorumCountsEachReplicaOnce(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{})
+	a, b, c := servers[0], servers[1], servers[2]
+
+	m, err := a.writeChunks(bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+
+	votes := newManifestVotes(2)
+	assert.Equal(t, 1, votes.add(b.id, m).count())
+	assert.Equal(t, 1, votes.add(b.id, m).count())
+
+	// A response from a peer the request was not sent to is dropped, as is
+	// a second one from the same peer.
+	peer, err := a.peer(b.id)
+	assert.Nil(t, err)
+	req := a.newRequest([]p2p.Peer{peer})
+	defer a.closeRequest(req)
+
+	found := MessageResponse{ID: req.id, Status: StatusFound, Manifest: m}
+	assert.Nil(t, a.handleMessageResponse(c.id, found))
+	assert.Nil(t, a.handleMessageResponse(b.id, found))
+	assert.Nil(t, a.handleMessageResponse(b.id, found))
+	assert.Len(t, req.resp, 1)
+	assert.Equal(t, b.id, (<-req.resp).from)
+}
+
+func TestGetIgnoresCopyOnNonReplica(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{ReplicationFactor: 1})
+	a := servers[0]
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("file-%d", i); a.ring.Owners(k, 1)[0] != a.id {
+			key = k
+		}
+	}
+
+	data := []byte("current data")
+	assert.Nil(t, a.Store(key, bytes.NewReader(data)))
+
+	// A copy left on a after ownership moved does not settle the read.
+	stale, err := a.writeChunks(bytes.NewReader([]byte("stale data")))
+	assert.Nil(t, err)
+	assert.Nil(t, a.storage.WriteManifest(key, stale))
+
+	assert.Equal(t, data, readFile(t, a, key))
+}
+
+func TestGetIgnoresCopyOnNonReplicaPeer(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{ReplicationFactor: 1})
+	a, b, c := servers[0], servers[1], servers[2]
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := fmt.Sprintf("file-%d", i); a.ring.Owners(k, 1)[0] == b.id {
+			key = k
+		}
+	}
+
+	// Only c, which does not own the key, has a copy; it does not vote.
+	stray, err := c.writeChunks(bytes.NewReader([]byte("stray data")))
+	assert.Nil(t, err)
+	assert.Nil(t, c.storage.WriteManifest(key, stray))
+
+	_, err = a.Get(key)
+	assert.ErrorContains(t, err, "not found")
+}
+
+func TestGetRejectsManifestWithInvalidChunkSize(t *testing.T) {
+	servers := newCluster(t, 2, FileServerOpts{})
+	a, b := servers[0], servers[1]
+
+	for _, size := range []int64{-1, storage.MaxChunkSize + 1} {
+		bad := &storage.Manifest{Key: "file", Size: 1, Chunks: []storage.ChunkRef{{Hash: "0123456789abcdef", Size: size}}}
+		assert.Nil(t, b.storage.WriteManifest("file", bad))
+
+		_, err := a.Get("file")
+		assert.ErrorContains(t, err, "invalid size")
+	}
+}
+
+func TestStoreGetOnBackends(t *testing.T) {
+	pack, err := storage.OpenPack(filepath.Join(t.TempDir(), "store.pack"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { pack.Close() })
+
+	a := newTestServer(t, FileServerOpts{Storage: storage.NewMemoryBackend()})
+	b := newTestServer(t, FileServerOpts{Storage: pack, BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+	assert.True(t, b.storage.Exists("file"))
+
+	assert.Nil(t, a.RemoveLocal("file"))
+	r, err := a.Get("file")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestGetReadsLegacyBlob(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+
+	data := make([]byte, 1<<16)
+	rand.Read(data)
+	enc, err := crypto.NewEncryptReader(a.encKey, bytes.NewReader(data))
+	assert.Nil(t, err)
+	_, err = a.storage.Backend().Write("legacy", enc)
+	assert.Nil(t, err)
+
+	assert.Equal(t, data, readFile(t, a, "legacy"))
+}
+
+func TestStatReturnsMetadata(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+
+	data := []byte("hello, metadata")
+	digest := sha256.Sum256(data)
+	assert.Nil(t, a.Store("file", bytes.NewReader(data), WithContentType("text/plain"), WithAttribute("author", "ops")))
+
+	meta, err := b.Stat("file")
+	assert.Nil(t, err)
+	assert.Equal(t, "file", meta.Key)
+	assert.Equal(t, int64(len(data)), meta.Size)
+	assert.Equal(t, hex.EncodeToString(digest[:]), meta.SHA256)
+	assert.Equal(t, a.id, meta.Owner)
+	assert.Equal(t, "text/plain", meta.ContentType)
+	assert.Equal(t, map[string]string{"author": "ops"}, meta.Attributes)
+	assert.True(t, meta.Created.Equal(meta.Modified))
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("updated"))))
+	assert.Nil(t, b.RemoveLocal("file"))
+
+	updated, err := b.Stat("file")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), updated.Size)
+	assert.True(t, updated.Created.Equal(meta.Created))
+	assert.True(t, updated.Modified.After(meta.Modified))
+	assert.Empty(t, updated.ContentType)
+}
+
+func TestStoreSameContentUpdatesMetadata(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("same")), WithContentType("text/plain"), WithVersioning()))
+	before, err := b.Stat("file")
+	assert.Nil(t, err)
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("same")), WithContentType("application/json"), WithAttribute("author", "ops")))
+
+	for _, fs := range []*FileServer{a, b} {
+		meta, err := fs.Stat("file")
+		assert.Nil(t, err)
+		assert.Equal(t, "application/json", meta.ContentType)
+		assert.Equal(t, map[string]string{"author": "ops"}, meta.Attributes)
+		assert.True(t, meta.Modified.After(before.Modified))
+		assert.NotEqual(t, before.Version, meta.Version)
+		assert.True(t, meta.Clock.Descends(before.Clock))
+	}
+
+	// Rewriting a versioned file with the same bytes still archives it.
+	versions, err := a.Versions("file")
+	assert.Nil(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func TestVersionHistoryAndRestore(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{
+		ReplicationFactor: 2,
+		WriteQuorum:       2,
+		VersionRetention:  storage.RetentionPolicy{MaxVersions: 3},
+	})
+
+	key := "doc"
+	var reader *FileServer
+	for _, fs := range servers {
+		if !slices.Contains(servers[0].ring.Owners(key, 2), fs.id) {
+			reader = fs
+		}
+	}
+
+	contents := [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+	assert.Nil(t, servers[0].Store(key, bytes.NewReader(contents[0]), WithVersioning()))
+	// Later stores keep the file versioned without asking again.
+	for _, data := range contents[1:] {
+		assert.Nil(t, servers[0].Store(key, bytes.NewReader(data)))
+	}
+
+	versions, err := reader.Versions(key)
+	assert.Nil(t, err)
+	if !assert.Len(t, versions, 3) {
+		return
+	}
+	for i, v := range versions {
+		r, err := reader.Get(key, WithVersion(v.Version))
+		if !assert.Nil(t, err) {
+			continue
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, contents[i], data)
+	}
+
+	assert.Nil(t, reader.Restore(key, versions[0].Version))
+	assert.Equal(t, contents[0], readFile(t, reader, key))
+
+	// The restore is a fourth version, so the oldest one was pruned.
+	restored, err := reader.Versions(key)
+	assert.Nil(t, err)
+	if assert.Len(t, restored, 3) {
+		assert.Equal(t, versions[1].Version, restored[0].Version)
+		assert.True(t, restored[2].Created.Equal(versions[0].Created))
+	}
+	_, err = reader.Get(key, WithVersion(versions[0].Version))
+	assert.NotNil(t, err)
+}
+
+// corruptChunk replaces fs's copy of a chunk with validly encrypted but
+// different contents of the same size, so only the hash check catches it.
+func corruptChunk(t *testing.T, fs *FileServer, c storage.ChunkRef) {
+	infos, err := fs.storage.Backend().List("")
+	assert.Nil(t, err)
+
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Key, c.Hash) {
+			continue
+		}
+
+		garbage := make([]byte, c.Size)
+		rand.Read(garbage)
+		enc, err := crypto.NewEncryptReader(fs.encKey, bytes.NewReader(garbage))
+		assert.Nil(t, err)
+		_, err = fs.storage.Backend().Write(info.Key, enc)
+		assert.Nil(t, err)
+		return
+	}
+
+	t.Fatalf("chunk %s not found on %s", c.Hash, fs.id)
+}
+
+func readFile(t *testing.T, fs *FileServer, key string) []byte {
+	r, err := fs.Get(key)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+
+	return data
+}
+
+func TestGetRepairsCorruptLocalChunk(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+
+	m, err := a.storage.ReadManifest("file")
+	assert.Nil(t, err)
+	corruptChunk(t, a, m.Chunks[1])
+
+	assert.Equal(t, data, readFile(t, a, "file"))
+	assert.Equal(t, uint64(1), a.Metrics().CorruptChunks)
+
+	// The corrupt copy was kept aside for inspection.
+	quarantined, err := a.storage.Quarantined()
+	assert.Nil(t, err)
+	if assert.Len(t, quarantined, 1) {
+		assert.True(t, strings.HasSuffix(quarantined[0].Key, m.Chunks[1].Hash))
+	}
+
+	// The intact copy fetched from b replaced the corrupt one.
+	assert.Equal(t, data, readFile(t, a, "file"))
+	assert.Equal(t, uint64(1), a.Metrics().CorruptChunks)
+}
+
+func TestGetFallsBackFromCorruptReplica(t *testing.T) {
+	// A read quorum of both replicas makes the reader consider each of
+	// them, whichever answers first.
+	servers := newCluster(t, 3, FileServerOpts{ReplicationFactor: 2, WriteQuorum: 2, ReadQuorum: 2})
+
+	// Repeating a block makes the file repeat chunks, which the remote
+	// stream carries only once.
+	block := make([]byte, 300<<10)
+	rand.Read(block)
+	data := bytes.Repeat(block, 4)
+
+	key := "file"
+	owners := servers[0].ring.Owners(key, 2)
+	byID := map[string]*FileServer{}
+	var reader *FileServer
+	for _, fs := range servers {
+		byID[fs.id] = fs
+		if !slices.Contains(owners, fs.id) {
+			reader = fs
+		}
+	}
+	bad, good := byID[owners[0]], byID[owners[1]]
+
+	assert.Nil(t, bad.Store(key, bytes.NewReader(data)))
+	m, err := bad.storage.ReadManifest(key)
+	assert.Nil(t, err)
+	corruptChunk(t, bad, m.Chunks[len(m.Chunks)/2])
+
+	// Flagging the good replica first makes the reader try the bad one.
+	reader.flagged[good.id]++
+
+	assert.Equal(t, data, readFile(t, reader, key))
+	assert.Equal(t, uint64(1), bad.Metrics().CorruptChunks)
+	assert.True(t, reader.isFlagged(bad.id))
+	assert.False(t, reader.storage.Exists(key))
+}
+
+// rotBlob flips a byte of a blob on disk, behind the backend's back.
+func rotBlob(t *testing.T, root, key string) {
+	path := filepath.Join(root, storage.DefaultPathTransformFunc(key).FullPath())
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+
+	data[len(data)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+}
+
+func TestScrubQuarantinesAndRepairs(t *testing.T) {
+	root := t.TempDir()
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{
+		BootstrapNodes: []string{a.transport.Addr()},
+		Storage:        storage.NewStorage(root, storage.DefaultPathTransformFunc),
+		ScrubRate:      1 << 30,
+	})
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+	assert.Nil(t, a.Store("other", bytes.NewReader([]byte("other data"))))
+
+	m, err := b.storage.ReadManifest("file")
+	assert.Nil(t, err)
+	blobs, err := b.storage.Blobs()
+	assert.Nil(t, err)
+	for _, info := range blobs {
+		if hash, _ := storage.ChunkHash(info.Key); hash == m.Chunks[1].Hash {
+			rotBlob(t, root, info.Key)
+		}
+	}
+	rotBlob(t, root, "other")
+
+	// An intact file stored whole before chunking passes on its checksum.
+	enc, err := crypto.NewEncryptReader(b.encKey, bytes.NewReader(data))
+	assert.Nil(t, err)
+	legacySize, err := b.storage.Backend().Write("legacy", enc)
+	assert.Nil(t, err)
+	blobs = append(blobs, storage.KeyInfo{Key: "legacy"})
+
+	report := b.Scrub()
+	assert.False(t, report.Running)
+	assert.Equal(t, len(blobs), report.Blobs)
+	assert.Equal(t, len(blobs), report.Scanned)
+	assert.Greater(t, report.Bytes, legacySize)
+	if assert.Len(t, report.Findings, 2) {
+		assert.Equal(t, "other", report.Findings[0].Key)
+		assert.True(t, report.Findings[0].Repaired)
+		assert.True(t, report.Findings[1].Chunk)
+		assert.True(t, report.Findings[1].Repaired)
+	}
+
+	quarantined, err := b.storage.Quarantined()
+	assert.Nil(t, err)
+	assert.Len(t, quarantined, 2)
+
+	// Both are whole again locally, so a is no longer needed.
+	a.Stop()
+	_, err = b.readLocalChunk(m.Chunks[1])
+	assert.Nil(t, err)
+	other, err := b.storage.ReadManifest("other")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), other.Size)
+
+	assert.Empty(t, b.Scrub().Findings)
+}
+
+func TestListAggregatesCluster(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{ReplicationFactor: 2, WriteQuorum: 2})
+
+	for i := 0; i < 6; i++ {
+		key := fmt.Sprintf("logs/%d", i)
+		assert.Nil(t, servers[i%3].Store(key, bytes.NewReader([]byte(key))))
+	}
+	assert.Nil(t, servers[0].Store("other", bytes.NewReader([]byte("other"))))
+
+	files, err := servers[1].List("logs/")
+	assert.Nil(t, err)
+	if assert.Len(t, files, 6) {
+		for i, f := range files {
+			key := fmt.Sprintf("logs/%d", i)
+			assert.Equal(t, key, f.Key)
+			assert.Equal(t, int64(len(key)), f.Size)
+			assert.ElementsMatch(t, servers[1].ring.Owners(key, 2), f.Nodes)
+		}
+	}
+}
+
+func TestRepairConvergesAfterNodeFailure(t *testing.T) {
+	opts := FileServerOpts{WriteQuorum: 2, RepairInterval: 50 * time.Millisecond}
+	a := newTestServer(t, opts)
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}, WriteQuorum: 2, RepairInterval: opts.RepairInterval})
+
+	cid, err := p2p.NewIdentity()
+	assert.Nil(t, err)
+	cOpts := opts
+	cOpts.BootstrapNodes = []string{a.transport.Addr(), b.transport.Addr()}
+	cOpts.Storage = storage.NewStorage(t.TempDir(), storage.DefaultPathTransformFunc)
+	cOpts.EncKey = crypto.NewAESKey()
+	c := startTestServer(t, cid, cOpts)
+	for _, fs := range []*FileServer{a, b, c} {
+		waitForPeers(t, fs, 2)
+	}
+
+	data := make([]byte, 8<<20)
+	rand.Read(data)
+
+	stored := make(chan error, 1)
+	go func() {
+		stored <- a.Store("file", bytes.NewReader(data))
+	}()
+
+	// Kill c as soon as it starts receiving chunks.
+	assert.Eventually(t, func() bool {
+		hashes, _ := c.storage.Chunks()
+		return len(hashes) > 0
+	}, 5*time.Second, time.Millisecond)
+	c.Stop()
+	assert.Nil(t, <-stored)
+
+	// Simulate the file having been lost on one of the surviving replicas.
+	assert.Nil(t, b.RemoveLocal("file"))
+
+	c = startTestServer(t, cid, cOpts)
+	assert.Eventually(t, func() bool {
+		return b.storage.Exists("file") && c.storage.Exists("file")
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, fs := range []*FileServer{b, c} {
+		m, err := fs.storage.ReadManifest("file")
+		assert.Nil(t, err)
+		assert.Empty(t, fs.missingChunks(m.Hashes()))
+	}
+	repaired := a.Metrics().KeysRepaired + b.Metrics().KeysRepaired + c.Metrics().KeysRepaired
+	assert.NotZero(t, repaired)
+
+	r, err := c.Get("file")
+	if assert.Nil(t, err) {
+		got, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestRemoveReachesOfflineReplica(t *testing.T) {
+	opts := FileServerOpts{WriteQuorum: 2, RepairInterval: 50 * time.Millisecond, TombstoneGracePeriod: 2 * time.Second}
+	a := newTestServer(t, opts)
+	bOpts := opts
+	bOpts.BootstrapNodes = []string{a.transport.Addr()}
+	b := newTestServer(t, bOpts)
+
+	cid, err := p2p.NewIdentity()
+	assert.Nil(t, err)
+	cOpts := opts
+	cOpts.BootstrapNodes = []string{a.transport.Addr(), b.transport.Addr()}
+	cOpts.Storage = storage.NewStorage(t.TempDir(), storage.DefaultPathTransformFunc)
+	cOpts.EncKey = crypto.NewAESKey()
+	c := startTestServer(t, cid, cOpts)
+	for _, fs := range []*FileServer{a, b, c} {
+		waitForPeers(t, fs, 2)
+	}
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("data"))))
+	assert.Eventually(t, func() bool { return c.storage.Exists("file") }, 5*time.Second, 10*time.Millisecond)
+
+	c.Stop()
+	assert.Nil(t, a.Remove("file"))
+	_, err = b.Get("file")
+	assert.ErrorIs(t, err, ErrDeleted)
+
+	// c comes back with the file and must not bring it back to life.
+	c = startTestServer(t, cid, cOpts)
+	assert.Eventually(t, func() bool {
+		m, err := c.storage.ReadManifest("file")
+		return err == nil && m.Deleted
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for _, fs := range []*FileServer{a, b, c} {
+		_, err := fs.Get("file")
+		assert.ErrorIs(t, err, ErrDeleted)
+
+		files, err := fs.List("")
+		assert.Nil(t, err)
+		assert.Empty(t, files)
+	}
+
+	assert.Eventually(t, func() bool {
+		c.pruneTombstones()
+		return !c.storage.Exists("file")
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestDisconnectedPeerIsDropped(t *testing.T) {
+	servers := newCluster(t, 3, FileServerOpts{})
+	a, b, c := servers[0], servers[1], servers[2]
+
+	c.Stop()
+	for _, fs := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			return len(fs.peerList()) == 1 && !slices.Contains(fs.ring.Nodes(), c.id)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("data"))))
+	assert.Equal(t, "data", string(readFile(t, b, "file")))
+}
+
+func TestMembersDiscoveredThroughSeed(t *testing.T) {
+	a := newTestServer(t, FileServerOpts{})
+	b := newTestServer(t, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	c := newTestServer(t, FileServerOpts{BootstrapNodes: []string{b.transport.Addr()}})
+
+	// c only knows b, but learns of a through gossip and connects to it.
+	for _, fs := range []*FileServer{a, b, c} {
+		waitForPeers(t, fs, 2)
+		assert.Len(t, fs.Members(), 3)
+	}
+
+	c.Stop()
+	for _, fs := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			return len(fs.Members()) == 2 && len(fs.ring.Nodes()) == 2
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestClusterWithDefaultHandshake(t *testing.T) {
+	opts := FileServerOpts{ProbeInterval: 50 * time.Millisecond, SuspectTimeout: 200 * time.Millisecond}
+	a := serveTestServer(t, p2p.DefaultHandshakeFunc, opts)
+	opts.BootstrapNodes = []string{a.transport.Addr()}
+	b := serveTestServer(t, p2p.DefaultHandshakeFunc, opts)
+	opts.BootstrapNodes = []string{b.transport.Addr()}
+	c := serveTestServer(t, p2p.DefaultHandshakeFunc, opts)
+
+	// Peers are known by their listen addresses, the IDs the servers put
+	// on the ring, so gossip and placement reach them.
+	for _, fs := range []*FileServer{a, b, c} {
+		waitForPeers(t, fs, 2)
+		assert.Len(t, fs.Members(), 3)
+	}
+
+	data := []byte("plain data")
+	assert.Nil(t, a.Store("file", bytes.NewReader(data)))
+	assert.Equal(t, data, readFile(t, c, "file"))
+
+	// Members that keep probing each other stay alive.
+	time.Sleep(time.Second)
+	for _, fs := range []*FileServer{a, b, c} {
+		assert.Len(t, fs.Members(), 3)
+	}
+}
+
+// syntheticReader yields size pseudo-random bytes without holding them in
+// memory. The data never repeats, so chunk deduplication cannot kick in.
+type syntheticReader struct {
+	rng       *mrand.ChaCha8
+	remaining int64
+}
+
+func newSyntheticReader(size int64) *syntheticReader {
+	return &syntheticReader{
+		rng:       mrand.NewChaCha8([32]byte{}),
+		remaining: size,
+	}
+}
+
+func (r *syntheticReader) Read(b []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	n, _ := r.rng.Read(b[:min(int64(len(b)), r.remaining)])
+	r.remaining -= int64(n)
+
+	return n, nil
+}
+
+func BenchmarkStoreGetLargeFile(b *testing.B) {
+	const size = 2 << 30
+
+	a := newTestServer(b, FileServerOpts{})
+	c := newTestServer(b, FileServerOpts{BootstrapNodes: []string{a.transport.Addr()}})
+	waitForPeers(b, c, 1)
+
+	var peakHeap atomic.Uint64
+	done := make(chan struct{})
+	go func() {
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peakHeap.Load() {
+					peakHeap.Store(stats.HeapInuse)
+				}
+			}
+		}
+	}()
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("large-%d", i)
+		if err := a.Store(key, newSyntheticReader(size)); err != nil {
+			b.Fatal(err)
+		}
+
+		assert.Nil(b, c.RemoveLocal(key))
+
+		r, err := c.Get(key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, r)
+		r.Close()
+		if err != nil || n != size {
+			b.Fatalf("read %d of %d bytes: %v", n, size, err)
+		}
+	}
+	b.StopTimer()
+	close(done)
+
+	b.ReportMetric(float64(peakHeap.Load())/(1<<20), "peak-heap-MB")
+}
+
+// partitionedWrites stores a different version of the same file on two
+// servers before connecting them, so neither write saw the other.
+func partitionedWrites(t *testing.T, mode ConflictMode) (*FileServer, *FileServer) {
+	opts := FileServerOpts{RepairInterval: 50 * time.Millisecond, ConflictMode: mode}
+	a := newTestServer(t, opts)
+	b := newTestServer(t, opts)
+
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("from a"))))
+	assert.Nil(t, b.Store("file", bytes.NewReader([]byte("from b"))))
+
+	assert.Nil(t, b.transport.Dial(a.transport.Addr()))
+	waitForPeers(t, a, 1)
+	waitForPeers(t, b, 1)
+
+	return a, b
+}
+
+func TestConcurrentWritesLastWriterWins(t *testing.T) {
+	a, b := partitionedWrites(t, LastWriterWins)
+
+	for _, fs := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			m, err := fs.storage.ReadManifest("file")
+			return err == nil && m.Owner == b.id && len(m.Siblings) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "from b", string(readFile(t, fs, "file")))
+	}
+}
+
+func TestConcurrentWritesKeepSiblings(t *testing.T) {
+	a, b := partitionedWrites(t, KeepSiblings)
+
+	for _, fs := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			m, err := fs.storage.ReadManifest("file")
+			return err == nil && len(m.Siblings) == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	_, err := a.Get("file", WithConflicts())
+	var conflict *ConflictError
+	if assert.ErrorAs(t, err, &conflict) {
+		assert.Len(t, conflict.Versions, 2)
+		for _, v := range conflict.Versions {
+			r, err := a.Get("file", WithVersion(v.Version))
+			if !assert.Nil(t, err) {
+				continue
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			assert.Nil(t, err)
+			want := "from b"
+			if v.Owner == a.id {
+				want = "from a"
+			}
+			assert.Equal(t, want, string(data))
+		}
+	}
+
+	// Without WithConflicts the later write is read.
+	assert.Equal(t, "from b", string(readFile(t, a, "file")))
+
+	// A write made with both versions in view resolves the conflict.
+	assert.Nil(t, a.Store("file", bytes.NewReader([]byte("merged"))))
+	for _, fs := range []*FileServer{a, b} {
+		assert.Eventually(t, func() bool {
+			m, err := fs.storage.ReadManifest("file")
+			return err == nil && len(m.Siblings) == 0
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, "merged", string(readFile(t, fs, "file")))
+	}
+}
@@ -0,0 +1,161 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+var ErrIntegrity = errors.New("integrity verification failed")
+
+// readLocalChunk reads and verifies a chunk from local storage. A chunk that
+// fails verification is quarantined, so it is fetched again rather than
+// served.
+func (s *FileServer) readLocalChunk(c storage.ChunkRef) ([]byte, error) {
+	data, err := s.readVerifiedChunk(c.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != c.Size {
+		return nil, fmt.Errorf("chunk %s is %d bytes, manifest says %d", c.Hash, len(data), c.Size)
+	}
+
+	return data, nil
+}
+
+func (s *FileServer) readVerifiedChunk(hash string) ([]byte, error) {
+	r, err := s.readChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, storage.MaxChunkSize+1))
+	if err == nil && hashChunk(data) == hash {
+		return data, nil
+	}
+
+	s.metrics.corruptChunks.Add(1)
+	log.Printf("[%s] local chunk %s is corrupt, quarantining it", s.transport.Addr(), hash)
+	if err := s.storage.QuarantineChunk(hash); err != nil {
+		log.Printf("[%s] failed to quarantine chunk %s: %v", s.transport.Addr(), hash, err)
+	}
+
+	return nil, fmt.Errorf("chunk %s: %w", hash, ErrIntegrity)
+}
+
+// servedBadChunk reports whether err shows peer served a chunk it should
+// not have: one that failed verification on receipt, or a stream it reset,
+// which it does when it finds its own copy corrupt.
+func servedBadChunk(err error) bool {
+	return errors.Is(err, ErrIntegrity) || errors.Is(err, p2p.ErrStreamReset)
+}
+
+// flagReplica records that peer failed to serve an intact chunk, so later
+// reads prefer other replicas.
+func (s *FileServer) flagReplica(peer, hash string) {
+	s.flagLock.Lock()
+	s.flagged[peer]++
+	s.flagLock.Unlock()
+
+	log.Printf("[%s] peer %s served corrupt chunk %s, flagging it", s.transport.Addr(), peer, hash)
+}
+
+func (s *FileServer) isFlagged(peer string) bool {
+	s.flagLock.Lock()
+	defer s.flagLock.Unlock()
+
+	return s.flagged[peer] > 0
+}
+
+// preferHealthy orders peers so flagged replicas are only tried last.
+func (s *FileServer) preferHealthy(peers []string) []string {
+	sorted := slices.Clone(peers)
+	slices.SortStableFunc(sorted, func(a, b string) int {
+		fa, fb := s.isFlagged(a), s.isFlagged(b)
+		switch {
+		case fa == fb:
+			return 0
+		case fb:
+			return -1
+		}
+		return 1
+	})
+
+	return sorted
+}
+
+// fallbackPeers lists the peers to retry a chunk of key from: the replicas
+// that agreed on the manifest, then the rest of the key's replicas and
+// finally everyone else, with flagged peers last and exclude left out.
+func (s *FileServer) fallbackPeers(key string, agreed []string, exclude string) []string {
+	owners, others := s.replicaPeers(key)
+
+	ids := slices.Clone(agreed)
+	for _, peer := range append(owners, others...) {
+		ids = append(ids, peer.ID())
+	}
+
+	seen := map[string]bool{exclude: true}
+	candidates := []string{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+
+	return s.preferHealthy(candidates)
+}
+
+// fetchChunk fetches a single chunk from the first of peers that returns it
+// intact, flagging the ones that return it corrupted.
+func (s *FileServer) fetchChunk(c storage.ChunkRef, peers []string) ([]byte, error) {
+	var errs []error
+	for _, id := range peers {
+		data, err := s.fetchChunkFrom(id, c)
+		if err == nil {
+			return data, nil
+		}
+		if servedBadChunk(err) {
+			s.flagReplica(id, c.Hash)
+		}
+		errs = append(errs, fmt.Errorf("peer %s: %w", id, err))
+	}
+
+	return nil, fmt.Errorf("no replica returned an intact copy of chunk %s: %w", c.Hash, errors.Join(errs...))
+}
+
+func (s *FileServer) fetchChunkFrom(id string, c storage.ChunkRef) ([]byte, error) {
+	peer, err := s.peer(id)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.call(peer, func(reqID uint64) any {
+		return MessageGetChunks{ID: reqID, Hashes: []string{c.Hash}}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.stream == nil {
+		return nil, fmt.Errorf("no stream for chunk %s", c.Hash)
+	}
+	defer resp.stream.Close()
+
+	data := make([]byte, c.Size)
+	if _, err := io.ReadFull(resp.stream, data); err != nil {
+		return nil, err
+	}
+	if hashChunk(data) != c.Hash {
+		s.metrics.corruptChunks.Add(1)
+		return nil, fmt.Errorf("chunk %s: %w", c.Hash, ErrIntegrity)
+	}
+
+	return data, nil
+}
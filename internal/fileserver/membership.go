@@ -0,0 +1,55 @@
+package fileserver
+
+import (
+	"log"
+
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+)
+
+// MessageGossip carries a membership protocol payload.
+type MessageGossip struct {
+	Payload []byte
+}
+
+func (s *FileServer) sendGossip(id string, payload []byte) error {
+	peer, err := s.peer(id)
+	if err != nil {
+		return err
+	}
+
+	return s.send(peer, &Message{Payload: MessageGossip{Payload: payload}})
+}
+
+// peerAddr returns the address the peer id advertised in the handshake, with
+// its host filled in from the connection, or "" if it is not connected.
+func (s *FileServer) peerAddr(id string) string {
+	peer, err := s.peer(id)
+	if err != nil {
+		return ""
+	}
+
+	return peer.ListenAddr()
+}
+
+// onMemberJoin puts a member that came alive on the placement ring and
+// connects to it if need be. Of each pair of members the one with the lower
+// ID dials, so the two do not both connect.
+func (s *FileServer) onMemberJoin(m p2p.Member) {
+	s.ring.Add(m.ID)
+
+	if _, err := s.peer(m.ID); err != nil && s.id < m.ID {
+		log.Printf("[%s] connecting to member %s at %s", s.transport.Addr(), m.ID, m.Addr)
+		s.transport.Connect(m.Addr)
+	}
+}
+
+// onMemberLeave takes a member that died or left off the placement ring, so
+// its files are placed on the remaining members.
+func (s *FileServer) onMemberLeave(m p2p.Member) {
+	s.ring.Remove(m.ID)
+}
+
+// Members returns the live members of the cluster, this node included.
+func (s *FileServer) Members() []p2p.Member {
+	return s.members.Members()
+}
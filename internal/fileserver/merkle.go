@@ -0,0 +1,178 @@
+package fileserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const (
+	// merkleDepth gives the tree 1<<merkleDepth leaf buckets.
+	merkleDepth = 8
+	// merkleStep is how many levels a sync descends per round trip.
+	merkleStep = 4
+)
+
+// SyncEntry is the version of one key a replica holds. Clocks has the
+// version vector of each of its heads.
+type SyncEntry struct {
+	Key      string
+	Digest   string
+	Modified time.Time
+	Clocks   []storage.VersionVector
+}
+
+func syncEntryOf(m *storage.Manifest) SyncEntry {
+	e := SyncEntry{Key: m.Key, Digest: m.Digest(), Modified: m.Modified}
+	for _, head := range m.Heads() {
+		e.Clocks = append(e.Clocks, head.Clock)
+	}
+
+	return e
+}
+
+// newer reports whether e should replace other. Later writes win, and the
+// digest breaks ties so every replica picks the same version.
+func (e SyncEntry) newer(other SyncEntry) bool {
+	if !e.Modified.Equal(other.Modified) {
+		return e.Modified.After(other.Modified)
+	}
+
+	return e.Digest > other.Digest
+}
+
+// supersedes reports whether e holds a version other has not seen, so
+// pushing it would change other's replica. Without version vectors on both
+// sides it falls back to newer.
+func (e SyncEntry) supersedes(other SyncEntry) bool {
+	clocks := slices.Concat(e.Clocks, other.Clocks)
+	if slices.ContainsFunc(clocks, func(c storage.VersionVector) bool { return len(c) == 0 }) {
+		return e.newer(other)
+	}
+
+	for _, c := range e.Clocks {
+		if !slices.ContainsFunc(other.Clocks, func(o storage.VersionVector) bool { return o.Descends(c) }) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// merkleTree hashes a set of keys into fixed buckets by key hash, so two
+// replicas holding the same keyspace build the same tree and can find the
+// buckets they disagree on by comparing only the nodes along the way.
+// Nodes are stored heap-style: the root is 1 and node i has children 2i and
+// 2i+1, which puts the leaves at [1<<merkleDepth, 2<<merkleDepth).
+type merkleTree struct {
+	nodes   [][]byte
+	buckets [][]SyncEntry
+}
+
+func newMerkleTree(entries []SyncEntry) *merkleTree {
+	t := &merkleTree{
+		nodes:   make([][]byte, 2<<merkleDepth),
+		buckets: make([][]SyncEntry, 1<<merkleDepth),
+	}
+
+	for _, e := range entries {
+		b := bucketOf(e.Key)
+		t.buckets[b] = append(t.buckets[b], e)
+	}
+
+	for b, bucket := range t.buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].Key < bucket[j].Key })
+
+		h := sha256.New()
+		for _, e := range bucket {
+			fmt.Fprintf(h, "%q %s %d\n", e.Key, e.Digest, e.Modified.UnixNano())
+		}
+		t.nodes[1<<merkleDepth+b] = h.Sum(nil)
+	}
+
+	for i := 1<<merkleDepth - 1; i > 0; i-- {
+		h := sha256.New()
+		h.Write(t.nodes[2*i])
+		h.Write(t.nodes[2*i+1])
+		t.nodes[i] = h.Sum(nil)
+	}
+
+	return t
+}
+
+func bucketOf(key string) int {
+	digest := sha256.Sum256([]byte(key))
+	return int(digest[0]) >> (8 - merkleDepth)
+}
+
+func isLeaf(node uint32) bool {
+	return node >= 1<<merkleDepth
+}
+
+func validNode(node uint32) bool {
+	return node > 0 && node < 2<<merkleDepth
+}
+
+func (t *merkleTree) hashes(nodes []uint32) [][]byte {
+	hashes := make([][]byte, len(nodes))
+	for i, node := range nodes {
+		hashes[i] = t.nodes[node]
+	}
+
+	return hashes
+}
+
+// diff returns the nodes whose hashes differ from the given remote ones.
+func (t *merkleTree) diff(nodes []uint32, hashes [][]byte) ([]uint32, error) {
+	if len(nodes) != len(hashes) {
+		return nil, fmt.Errorf("got %d hashes for %d nodes", len(hashes), len(nodes))
+	}
+
+	var diff []uint32
+	for i, node := range nodes {
+		if !validNode(node) {
+			return nil, fmt.Errorf("invalid merkle node %d", node)
+		}
+		if !bytes.Equal(t.nodes[node], hashes[i]) {
+			diff = append(diff, node)
+		}
+	}
+
+	return diff, nil
+}
+
+// descend returns the descendants merkleStep levels below nodes, stopping
+// at the leaves.
+func descend(nodes []uint32) []uint32 {
+	var children []uint32
+	for _, node := range nodes {
+		depth := 0
+		for n := node; n > 1; n >>= 1 {
+			depth++
+		}
+
+		step := min(merkleStep, merkleDepth-depth)
+		first := node << step
+		for i := uint32(0); i < 1<<step; i++ {
+			children = append(children, first+i)
+		}
+	}
+
+	return children
+}
+
+func (t *merkleTree) leafEntries(leaves []uint32) []SyncEntry {
+	var entries []SyncEntry
+	for _, leaf := range leaves {
+		if isLeaf(leaf) && validNode(leaf) {
+			entries = append(entries, t.buckets[leaf-1<<merkleDepth]...)
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,70 @@
+package fileserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func merkleEntries(n int) []SyncEntry {
+	entries := []SyncEntry{}
+	for i := 0; i < n; i++ {
+		entries = append(entries, SyncEntry{
+			Key:      fmt.Sprintf("key-%d", i),
+			Digest:   fmt.Sprintf("digest-%d", i),
+			Modified: time.Unix(int64(i), 0),
+		})
+	}
+
+	return entries
+}
+
+// findDiff walks a against b the way syncWith does and returns the
+// differing leaves.
+func findDiff(t *testing.T, a, b *merkleTree) []uint32 {
+	nodes := []uint32{1}
+	for {
+		diff, err := b.diff(nodes, a.hashes(nodes))
+		assert.Nil(t, err)
+		if len(diff) == 0 || isLeaf(diff[0]) {
+			return diff
+		}
+		nodes = descend(diff)
+	}
+}
+
+func TestMerkleTreeFindsDivergentBuckets(t *testing.T) {
+	entries := merkleEntries(1000)
+
+	a := newMerkleTree(entries)
+	b := newMerkleTree(append([]SyncEntry{}, entries...))
+	assert.Empty(t, findDiff(t, a, b))
+
+	changed := append([]SyncEntry{}, entries...)
+	changed[10].Modified = changed[10].Modified.Add(time.Second)
+	changed = append(changed[:500], changed[501:]...)
+
+	b = newMerkleTree(changed)
+	leaves := findDiff(t, a, b)
+	assert.Len(t, leaves, 2)
+
+	keys := []string{}
+	for _, e := range a.leafEntries(leaves) {
+		keys = append(keys, e.Key)
+	}
+	assert.Contains(t, keys, "key-10")
+	assert.Contains(t, keys, "key-500")
+}
+
+func TestMerkleTreeRejectsInvalidNodes(t *testing.T) {
+	tree := newMerkleTree(nil)
+
+	_, err := tree.diff([]uint32{0}, [][]byte{nil})
+	assert.NotNil(t, err)
+	_, err = tree.diff([]uint32{2 << merkleDepth}, [][]byte{nil})
+	assert.NotNil(t, err)
+	_, err = tree.diff([]uint32{1}, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,33 @@
+package fileserver
+
+import "sync/atomic"
+
+// Metrics is a snapshot of a file server's counters.
+type Metrics struct {
+	// SyncRounds counts anti-entropy exchanges with a peer.
+	SyncRounds uint64
+	// KeysRepaired counts files pushed to a replica that lacked them or
+	// held an older version.
+	KeysRepaired uint64
+	// RepairErrors counts failed exchanges and failed pushes.
+	RepairErrors uint64
+	// CorruptChunks counts chunks that failed verification, whether read
+	// locally or received from a peer.
+	CorruptChunks uint64
+}
+
+type metrics struct {
+	syncRounds    atomic.Uint64
+	keysRepaired  atomic.Uint64
+	repairErrors  atomic.Uint64
+	corruptChunks atomic.Uint64
+}
+
+func (s *FileServer) Metrics() Metrics {
+	return Metrics{
+		SyncRounds:    s.metrics.syncRounds.Load(),
+		KeysRepaired:  s.metrics.keysRepaired.Load(),
+		RepairErrors:  s.metrics.repairErrors.Load(),
+		CorruptChunks: s.metrics.corruptChunks.Load(),
+	}
+}
@@ -0,0 +1,150 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const defaultReadQuorum = 1
+
+// majority is the default write quorum for n replicas.
+func majority(n int) int {
+	return n/2 + 1
+}
+
+// quorumSize caps a configured quorum at the number of replicas the ring
+// can currently place a key on, so a cluster smaller than the replication
+// factor can still make progress.
+func (s *FileServer) quorumSize(key string, quorum int) int {
+	return min(quorum, len(s.ring.Owners(key, s.replicationFactor)))
+}
+
+// manifestVote is one version of a file's manifest and the replicas that
+// returned it.
+type manifestVote struct {
+	manifest *storage.Manifest
+	local    bool
+	peers    []string
+}
+
+func (v *manifestVote) count() int {
+	n := len(v.peers)
+	if v.local {
+		n++
+	}
+
+	return n
+}
+
+// manifestVotes tallies the manifests replicas return for a key until need
+// of them agree.
+type manifestVotes struct {
+	need   int
+	votes  map[string]*manifestVote
+	voters map[string]*manifestVote
+	errs   []error
+}
+
+func newManifestVotes(need int) *manifestVotes {
+	return &manifestVotes{
+		need:   need,
+		votes:  make(map[string]*manifestVote),
+		voters: make(map[string]*manifestVote),
+	}
+}
+
+// add records m as returned by peer from, or by local storage if from is
+// empty, and returns its vote. Replicas agree when they hold the same write,
+// not merely the same content. Each replica votes once; a later manifest
+// from the same one does not count again.
+func (t *manifestVotes) add(from string, m *storage.Manifest) *manifestVote {
+	if v, ok := t.voters[from]; ok {
+		return v
+	}
+
+	id := m.Version + " " + m.Digest()
+
+	v, ok := t.votes[id]
+	if !ok {
+		v = &manifestVote{manifest: m}
+		t.votes[id] = v
+	}
+	t.voters[from] = v
+
+	if from == "" {
+		v.local = true
+	} else {
+		v.peers = append(v.peers, from)
+	}
+
+	return v
+}
+
+func (t *manifestVotes) best() int {
+	best := 0
+	for _, v := range t.votes {
+		best = max(best, v.count())
+	}
+
+	return best
+}
+
+func (t *manifestVotes) err(key string) error {
+	if len(t.votes) == 0 {
+		return fmt.Errorf("file %s not found on network: %w", key, errors.Join(t.errs...))
+	}
+
+	return fmt.Errorf("read quorum not met for file %s: need %d matching replicas, got %d: %w", key, t.need, t.best(), errors.Join(t.errs...))
+}
+
+// findManifest asks peers for key's manifest, or for the given archived
+// version of it, and returns the first one enough replicas agree on,
+// counting the votes already in t.
+func (s *FileServer) findManifest(key, version string, peers []p2p.Peer, t *manifestVotes) (*manifestVote, error) {
+	req := s.newRequest(peers)
+	defer s.closeRequest(req)
+
+	msg := Message{
+		Payload: MessageGet{
+			ID:      req.id,
+			Key:     key,
+			Version: version,
+		},
+	}
+
+	sent := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			t.errs = append(t.errs, fmt.Errorf("peer %s: %w", peer.ID(), err))
+			continue
+		}
+		sent++
+	}
+
+	timeout := time.After(requestTimeout)
+	for i := 0; i < sent; i++ {
+		select {
+		case resp := <-req.resp:
+			if resp.Status != StatusFound || resp.Manifest == nil {
+				t.errs = append(t.errs, resp.err())
+				continue
+			}
+			if err := resp.Manifest.Validate(); err != nil {
+				t.errs = append(t.errs, fmt.Errorf("peer %s: %w", resp.from, err))
+				continue
+			}
+			if v := t.add(resp.from, resp.Manifest); v.count() >= t.need {
+				return v, nil
+			}
+		case <-timeout:
+			t.errs = append(t.errs, fmt.Errorf("timed out waiting for %d of %d peers", sent-i, sent))
+			return nil, t.err(key)
+		}
+	}
+
+	return nil, t.err(key)
+}
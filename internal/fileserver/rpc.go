@@ -0,0 +1,238 @@
+package fileserver
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/p2p"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const requestTimeout = time.Second * 5
+
+type Status int
+
+const (
+	StatusOK Status = iota
+	StatusFound
+	StatusNotFound
+	StatusError
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusOK:
+		return "ok"
+	case StatusFound:
+		return "found"
+	case StatusNotFound:
+		return "not found"
+	case StatusError:
+		return "error"
+	}
+
+	return fmt.Sprintf("status(%d)", int(s))
+}
+
+type MessageResponse struct {
+	ID       uint64
+	Status   Status
+	Err      string
+	StreamID uint32
+	Manifest *storage.Manifest
+	Missing  []string
+	Diff     []uint32
+	Entries  []SyncEntry
+	Keys     []storage.KeyInfo
+	Versions []storage.Metadata
+}
+
+type response struct {
+	MessageResponse
+	from   string
+	stream *p2p.Stream
+}
+
+func (r response) err() error {
+	switch r.Status {
+	case StatusOK, StatusFound:
+		return nil
+	case StatusError:
+		return fmt.Errorf("peer %s: %s", r.from, r.Err)
+	}
+
+	return fmt.Errorf("peer %s: %s", r.from, r.Status)
+}
+
+// request awaits one response from each of the peers it was sent to.
+// Responses from other peers, or repeated ones, are dropped.
+type request struct {
+	id      uint64
+	resp    chan response
+	waiting map[string]bool
+}
+
+var requestID atomic.Uint64
+
+func (s *FileServer) newRequest(peers []p2p.Peer) *request {
+	req := &request{
+		id:      requestID.Add(1),
+		resp:    make(chan response, len(peers)),
+		waiting: make(map[string]bool, len(peers)),
+	}
+	for _, peer := range peers {
+		req.waiting[peer.ID()] = true
+	}
+
+	s.pendingLock.Lock()
+	s.pending[req.id] = req
+	s.pendingLock.Unlock()
+
+	return req
+}
+
+func (s *FileServer) closeRequest(req *request) {
+	s.pendingLock.Lock()
+	delete(s.pending, req.id)
+	s.pendingLock.Unlock()
+
+	for {
+		select {
+		case resp := <-req.resp:
+			if resp.stream != nil {
+				resp.stream.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// sendRequest registers a request for a single response and sends the
+// payload built for its ID to peer. The caller must close the request.
+func (s *FileServer) sendRequest(peer p2p.Peer, build func(id uint64) any) (*request, error) {
+	req := s.newRequest([]p2p.Peer{peer})
+
+	if err := s.send(peer, &Message{Payload: build(req.id)}); err != nil {
+		s.closeRequest(req)
+		return nil, err
+	}
+
+	return req, nil
+}
+
+func (s *FileServer) awaitResponse(req *request, peer p2p.Peer) (response, error) {
+	select {
+	case resp := <-req.resp:
+		return resp, resp.err()
+	case <-time.After(requestTimeout):
+		return response{}, fmt.Errorf("peer %s: request timed out", peer.ID())
+	}
+}
+
+func (s *FileServer) call(peer p2p.Peer, build func(id uint64) any) (response, error) {
+	req, err := s.sendRequest(peer, build)
+	if err != nil {
+		return response{}, err
+	}
+	defer s.closeRequest(req)
+
+	return s.awaitResponse(req, peer)
+}
+
+// gather sends the payload built for a request to every peer and returns
+// the successful responses, along with the errors of the peers that failed
+// or did not answer in time.
+func (s *FileServer) gather(build func(id uint64) any) ([]response, []error) {
+	peers := s.peerList()
+	req := s.newRequest(peers)
+	defer s.closeRequest(req)
+
+	msg := Message{Payload: build(req.id)}
+
+	var errs []error
+	sent := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			errs = append(errs, fmt.Errorf("peer %s: %w", peer.ID(), err))
+			continue
+		}
+		sent++
+	}
+
+	var resps []response
+	timeout := time.After(requestTimeout)
+	for i := 0; i < sent; i++ {
+		select {
+		case resp := <-req.resp:
+			if err := resp.err(); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			resps = append(resps, resp)
+		case <-timeout:
+			return resps, append(errs, fmt.Errorf("timed out waiting for %d of %d peers", sent-i, sent))
+		}
+	}
+
+	return resps, errs
+}
+
+func (s *FileServer) respond(from string, resp MessageResponse) error {
+	peer, err := s.peer(from)
+	if err != nil {
+		return err
+	}
+
+	return s.send(peer, &Message{Payload: resp})
+}
+
+func (s *FileServer) respondErr(from string, id uint64, err error) error {
+	if rerr := s.respond(from, MessageResponse{ID: id, Status: StatusError, Err: err.Error()}); rerr != nil {
+		return rerr
+	}
+
+	return err
+}
+
+func (s *FileServer) handleMessageResponse(from string, msg MessageResponse) error {
+	resp := response{
+		MessageResponse: msg,
+		from:            from,
+	}
+
+	if msg.StreamID != 0 {
+		peer, err := s.peer(from)
+		if err != nil {
+			return err
+		}
+
+		stream, err := peer.AcceptStream(msg.StreamID)
+		if err != nil {
+			return err
+		}
+		resp.stream = stream
+	}
+
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	req, ok := s.pending[msg.ID]
+	if ok && req.waiting[from] {
+		delete(req.waiting, from)
+		select {
+		case req.resp <- resp:
+			return nil
+		default:
+		}
+	}
+
+	// The request already completed or timed out, or was never sent to this
+	// peer, so nobody will read the stream attached to the response.
+	if resp.stream != nil {
+		resp.stream.Close()
+	}
+
+	return nil
+}
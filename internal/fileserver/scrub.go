@@ -0,0 +1,354 @@
+package fileserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/crypto"
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const (
+	defaultScrubInterval = time.Hour * 24
+	// defaultScrubRate is how many bytes per second the scrubber reads.
+	defaultScrubRate = 4 << 20
+)
+
+var errBlobChecksum = errors.New("blob does not match its recorded checksum")
+
+// ScrubReport describes the progress and findings of the current or, when
+// none is running, the last scrub pass.
+type ScrubReport struct {
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	// Blobs is how many blobs the pass covers, Scanned how many of them it
+	// has verified so far and Bytes how much it has read.
+	Blobs    int
+	Scanned  int
+	Bytes    int64
+	Findings []ScrubFinding
+}
+
+// ScrubFinding is a corrupt blob the scrubber quarantined.
+type ScrubFinding struct {
+	// Key is the backend key of the blob, a file's key for its manifest.
+	Key   string
+	Chunk bool
+	Err   error
+	// Repaired is set once an intact copy was fetched from a replica.
+	Repaired bool
+	Time     time.Time
+}
+
+func (s *FileServer) ScrubReport() ScrubReport {
+	s.scrubLock.Lock()
+	defer s.scrubLock.Unlock()
+
+	r := s.scrubReport
+	r.Findings = slices.Clone(r.Findings)
+
+	return r
+}
+
+func (s *FileServer) updateScrubReport(fn func(r *ScrubReport)) {
+	s.scrubLock.Lock()
+	fn(&s.scrubReport)
+	s.scrubLock.Unlock()
+}
+
+// Scrub runs a scrub pass now, unless one is already running, and returns
+// its report. Every blob in storage is read back, at no more than ScrubRate
+// bytes per second, and checked against the checksum recorded when it was
+// written. Chunks are also decrypted, which checks their authentication
+// tags, and hashed, and manifests decoded. Corrupt blobs are quarantined and
+// an intact copy fetched from a replica in their place.
+func (s *FileServer) Scrub() ScrubReport {
+	if !s.scrubbing.TryLock() {
+		return s.ScrubReport()
+	}
+	defer s.scrubbing.Unlock()
+
+	s.scrub()
+
+	return s.ScrubReport()
+}
+
+func (s *FileServer) scrub() {
+	blobs, err := s.storage.Blobs()
+	if err != nil {
+		log.Printf("[%s] scrub failed to list storage: %v", s.transport.Addr(), err)
+		return
+	}
+
+	// Manifests go first, so a corrupt one is out of the way before the
+	// chunks are matched up with the files that use them.
+	var manifests, chunks []storage.KeyInfo
+	for _, info := range blobs {
+		if _, ok := storage.ChunkHash(info.Key); ok {
+			chunks = append(chunks, info)
+		} else {
+			manifests = append(manifests, info)
+		}
+	}
+
+	s.updateScrubReport(func(r *ScrubReport) {
+		*r = ScrubReport{Running: true, Started: time.Now(), Blobs: len(blobs)}
+	})
+	defer s.updateScrubReport(func(r *ScrubReport) {
+		r.Running = false
+		r.Finished = time.Now()
+	})
+
+	log.Printf("[%s] scrubbing %d blobs", s.transport.Addr(), len(blobs))
+
+	start := time.Now()
+	var scanned int64
+	check := func(info storage.KeyInfo, verify func(io.Reader) error, repair func() error) bool {
+		n, err := s.scrubBlob(info, verify)
+		scanned += n
+		s.updateScrubReport(func(r *ScrubReport) {
+			r.Scanned++
+			r.Bytes += n
+		})
+
+		if err != nil {
+			s.quarantine(info.Key, err, repair)
+		}
+
+		return s.throttle(start, scanned)
+	}
+
+	for _, info := range manifests {
+		verify := func(r io.Reader) error {
+			// Blobs that are not manifests, such as files stored whole
+			// before chunking, are only checked against their checksum.
+			if _, err := storage.DecodeManifest(r); err != nil && !errors.Is(err, storage.ErrNotManifest) {
+				return err
+			}
+			return nil
+		}
+		repair := func() error { return s.refetchFile(info.Key, "") }
+		if key, version, ok := storage.VersionOf(info.Key); ok {
+			repair = func() error { return s.refetchFile(key, version) }
+		}
+
+		if !check(info, verify, repair) {
+			return
+		}
+	}
+
+	refs, err := s.chunkRefs()
+	if err != nil {
+		log.Printf("[%s] scrub failed to read manifests: %v", s.transport.Addr(), err)
+		return
+	}
+
+	for _, info := range chunks {
+		hash, _ := storage.ChunkHash(info.Key)
+		verify := func(r io.Reader) error { return s.verifyChunkBlob(hash, r) }
+		repair := func() error { return s.refetchChunk(hash, refs[hash]) }
+
+		if !check(info, verify, repair) {
+			return
+		}
+	}
+
+	log.Printf("[%s] scrub finished, %d blobs, %d bytes", s.transport.Addr(), len(blobs), scanned)
+}
+
+// scrubBlob streams the blob back through its checksum and verify, returning
+// how many bytes it read. A blob that has gone since it was listed is not an
+// error.
+func (s *FileServer) scrubBlob(info storage.KeyInfo, verify func(io.Reader) error) (int64, error) {
+	r, err := s.storage.ReadBlob(info.Key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	digest := sha256.New()
+	counter := &countingWriter{}
+	tee := io.TeeReader(r, io.MultiWriter(digest, counter))
+
+	verr := verify(tee)
+	// Whatever verify left unread still counts toward the checksum.
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return counter.n, err
+	}
+
+	if info.Checksum != "" && hex.EncodeToString(digest.Sum(nil)) != info.Checksum {
+		return counter.n, errBlobChecksum
+	}
+
+	return counter.n, verr
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+// verifyChunkBlob decrypts a chunk blob and checks it against hash, holding
+// no more than a chunk's worth of plaintext.
+func (s *FileServer) verifyChunkBlob(hash string, r io.Reader) error {
+	dec, err := crypto.NewDecryptReader(s.encKey, r)
+	if err != nil {
+		return err
+	}
+
+	plain, err := io.ReadAll(io.LimitReader(dec, storage.MaxChunkSize+1))
+	if err != nil {
+		return err
+	}
+	if len(plain) > storage.MaxChunkSize || hashChunk(plain) != hash {
+		return ErrIntegrity
+	}
+
+	return nil
+}
+
+func (s *FileServer) quarantine(key string, cause error, repair func() error) {
+	_, isChunk := storage.ChunkHash(key)
+	if isChunk {
+		s.metrics.corruptChunks.Add(1)
+	}
+
+	finding := ScrubFinding{Key: key, Chunk: isChunk, Err: cause, Time: time.Now()}
+	log.Printf("[%s] scrub found blob %s corrupt: %v", s.transport.Addr(), key, cause)
+
+	if err := s.storage.Quarantine(key); err != nil {
+		log.Printf("[%s] failed to quarantine blob %s: %v", s.transport.Addr(), key, err)
+	} else if err := repair(); err != nil {
+		log.Printf("[%s] failed to repair blob %s: %v", s.transport.Addr(), key, err)
+	} else {
+		finding.Repaired = true
+		log.Printf("[%s] repaired blob %s from a replica", s.transport.Addr(), key)
+	}
+
+	s.updateScrubReport(func(r *ScrubReport) {
+		r.Findings = append(r.Findings, finding)
+	})
+}
+
+// throttle sleeps until reading scanned bytes since start fits ScrubRate,
+// returning false if the server stops in the meantime.
+func (s *FileServer) throttle(start time.Time, scanned int64) bool {
+	due := start.Add(time.Duration(float64(scanned) / float64(s.scrubRate) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		select {
+		case <-s.quitChan:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.quitChan:
+		return false
+	}
+}
+
+type chunkRef struct {
+	key string
+	ref storage.ChunkRef
+}
+
+// chunkRefs maps each chunk hash to a file, or a version of one, that
+// uses it.
+func (s *FileServer) chunkRefs() (map[string]chunkRef, error) {
+	manifests, err := s.storage.Manifests()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.storage.AllVersions()
+	if err != nil {
+		return nil, err
+	}
+	manifests = append(manifests, versions...)
+
+	refs := make(map[string]chunkRef)
+	for _, m := range manifests {
+		for _, c := range m.AllChunks() {
+			refs[c.Hash] = chunkRef{key: m.Key, ref: c}
+		}
+	}
+
+	return refs, nil
+}
+
+// refetchChunk replaces a quarantined chunk with a copy from one of the
+// replicas of a file that uses it. A chunk no file uses is not fetched.
+func (s *FileServer) refetchChunk(hash string, ref chunkRef) error {
+	if ref.key == "" {
+		return fmt.Errorf("no file uses chunk %s", hash)
+	}
+
+	data, err := s.fetchChunk(ref.ref, s.fallbackPeers(ref.key, nil, ""))
+	if err != nil {
+		return err
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	return s.writeChunk(hash, data)
+}
+
+// refetchFile restores a file whose manifest was quarantined, or the given
+// archived version of it, from the replicas, along with any of its chunks
+// this node lacks.
+func (s *FileServer) refetchFile(key, version string) error {
+	vote, err := s.lookup(key, version)
+	if err != nil {
+		return err
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	if err := s.fetchMissing(vote.manifest, vote.peers); err != nil {
+		return err
+	}
+
+	if version != "" {
+		return s.storage.WriteVersion(key, vote.manifest)
+	}
+
+	return s.storage.WriteManifest(key, vote.manifest)
+}
+
+func (s *FileServer) scrubLoop() {
+	ticker := time.NewTicker(s.scrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Scrub()
+		case <-s.quitChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package fileserver
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+const defaultTombstoneGracePeriod = time.Hour * 24 * 7
+
+var ErrDeleted = errors.New("file was deleted")
+
+func (s *FileServer) tombstoneExpired(m *storage.Manifest) bool {
+	return m.Deleted && len(m.Siblings) == 0 && time.Since(m.Modified) > s.tombstoneGrace
+}
+
+// pruneTombstones drops the tombstones older than the grace period, by
+// which time every replica should have learned of the delete. Expired
+// tombstones are no longer synced either, so replicas that still hold one
+// do not push it back.
+func (s *FileServer) pruneTombstones() {
+	manifests, err := s.storage.Manifests()
+	if err != nil {
+		log.Printf("[%s] failed to read manifests for tombstone collection: %v", s.transport.Addr(), err)
+		return
+	}
+
+	pruned := 0
+	for _, m := range manifests {
+		if !s.tombstoneExpired(m) {
+			continue
+		}
+
+		if err := s.storage.Delete(m.Key); err != nil {
+			log.Printf("[%s] failed to drop tombstone of file %s: %v", s.transport.Addr(), m.Key, err)
+			continue
+		}
+		pruned++
+	}
+
+	if pruned > 0 {
+		log.Printf("[%s] dropped %d expired tombstones", s.transport.Addr(), pruned)
+	}
+}
@@ -0,0 +1,210 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"sort"
+	"time"
+
+	"github.com/AaravShirvoikar/scatterfs/storage"
+)
+
+var defaultVersionRetention = storage.RetentionPolicy{MaxVersions: 10}
+
+type MessageVersions struct {
+	ID  uint64
+	Key string
+}
+
+// writeManifest merges m into key's current manifest, settling concurrent
+// versions by the conflict mode, and trims the history of a versioned file
+// to the retention policy. Versions the local manifest supersedes are
+// ignored, so a late replica cannot undo a newer write or a delete.
+func (s *FileServer) writeManifest(key string, m *storage.Manifest) error {
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+
+	local, err := s.storage.ReadManifest(key)
+	if err != nil {
+		local = nil
+	}
+
+	resolved := resolve(local, m, s.conflictMode)
+	if resolved == nil {
+		log.Printf("[%s] ignored stale version %s of file %s", s.transport.Addr(), m.Version, key)
+		return nil
+	}
+	if len(resolved.Siblings) > 0 {
+		log.Printf("[%s] file %s has %d conflicting versions", s.transport.Addr(), key, len(resolved.Siblings)+1)
+	}
+
+	if err := s.storage.WriteManifest(key, resolved); err != nil {
+		return err
+	}
+
+	if resolved.Versioned {
+		if _, err := s.storage.PruneVersions(key, s.versionRetention); err != nil {
+			log.Printf("[%s] failed to prune versions of file %s: %v", s.transport.Addr(), key, err)
+		}
+	}
+
+	return nil
+}
+
+// localVersions returns the versions of key this node holds: its archived
+// ones and the current one with its siblings.
+func (s *FileServer) localVersions(key string) ([]storage.Metadata, error) {
+	versions, err := s.storage.Versions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if m, err := s.storage.ReadManifest(key); err == nil {
+		versions = append(versions, m.Heads()...)
+	}
+
+	meta := make([]storage.Metadata, len(versions))
+	for i, m := range versions {
+		meta[i] = m.Metadata()
+	}
+
+	return meta, nil
+}
+
+// Versions returns the versions of key held anywhere in the cluster, oldest
+// first: every archived version of a versioned file, and the current version
+// on each replica. Peers that fail to answer are reported in the error,
+// alongside whatever the rest of the cluster returned.
+func (s *FileServer) Versions(key string) ([]storage.Metadata, error) {
+	local, err := s.localVersions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make(map[string]storage.Metadata)
+	merge := func(list []storage.Metadata) {
+		for _, v := range list {
+			versions[v.Version] = v
+		}
+	}
+	merge(local)
+
+	resps, errs := s.gather(func(id uint64) any {
+		return MessageVersions{ID: id, Key: key}
+	})
+	for _, resp := range resps {
+		merge(resp.Versions)
+	}
+
+	list := make([]storage.Metadata, 0, len(versions))
+	for _, v := range versions {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+
+	if len(errs) > 0 {
+		return list, fmt.Errorf("failed to list versions on some peers: %w", errors.Join(errs...))
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("file %s not found on network", key)
+	}
+
+	return list, nil
+}
+
+// Restore makes an earlier version of key current again. Its contents and
+// metadata are stored as a new version, so the history is kept intact.
+func (s *FileServer) Restore(key, version string) error {
+	vote, err := s.lookup(key, version)
+	if err != nil {
+		return err
+	}
+
+	s.gcLock.RLock()
+	defer s.gcLock.RUnlock()
+
+	if err := s.fetchMissing(vote.manifest, vote.peers); err != nil {
+		return err
+	}
+
+	m := *vote.manifest
+	m.Modified = time.Now()
+	m.Version = storage.NewVersionID(m.Modified)
+	m.Versioned = true
+	m.Owner = s.id
+	m.Attributes = maps.Clone(m.Attributes)
+	m.Clock = s.nextClock(s.current(key))
+	m.Siblings = nil
+
+	log.Printf("[%s] restoring version %s of file %s", s.transport.Addr(), version, key)
+
+	return s.put(key, &m)
+}
+
+// fetchMissing stores the chunks of m this node lacks, fetching them from
+// the peers in agreed or the file's other replicas. The caller holds gcLock.
+func (s *FileServer) fetchMissing(m *storage.Manifest, agreed []string) error {
+	for _, c := range m.AllChunks() {
+		if s.storage.HasChunk(c.Hash) {
+			continue
+		}
+
+		data, err := s.fetchChunk(c, s.fallbackPeers(m.Key, agreed, ""))
+		if err != nil {
+			return err
+		}
+		if err := s.writeChunk(c.Hash, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneVersions trims the history of every versioned file to the retention
+// policy, which matters for age limits as files are not always rewritten.
+func (s *FileServer) pruneVersions() {
+	keys, err := s.storage.VersionedKeys()
+	if err != nil {
+		log.Printf("[%s] failed to list versioned files: %v", s.transport.Addr(), err)
+		return
+	}
+
+	pruned := 0
+	for _, key := range keys {
+		n, err := s.storage.PruneVersions(key, s.versionRetention)
+		pruned += n
+		if err != nil {
+			log.Printf("[%s] failed to prune versions of file %s: %v", s.transport.Addr(), key, err)
+		}
+	}
+
+	if pruned > 0 {
+		log.Printf("[%s] pruned %d old file versions", s.transport.Addr(), pruned)
+	}
+}
+
+func (s *FileServer) handleMessageGetVersion(from string, msg MessageGet) error {
+	m, err := s.storage.ReadVersion(msg.Key, msg.Version)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("[%s] does not have version %s of file %s", s.transport.Addr(), msg.Version, msg.Key)
+		return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusNotFound})
+	}
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
+
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusFound, Manifest: m})
+}
+
+func (s *FileServer) handleMessageVersions(from string, msg MessageVersions) error {
+	versions, err := s.localVersions(msg.Key)
+	if err != nil {
+		return s.respondErr(from, msg.ID, err)
+	}
+
+	return s.respond(from, MessageResponse{ID: msg.ID, Status: StatusOK, Versions: versions})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,7 +17,16 @@ import (
 	"github.com/AaravShirvoikar/scatterfs/storage"
 )
 
-func makeFileServer(listenAddr string, nodes ...string) *fileserver.FileServer {
+func loadIdentity(listenAddr string) *p2p.Identity {
+	id, err := p2p.LoadOrCreateIdentity(fmt.Sprintf("identity_keys/%s_id", listenAddr))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return id
+}
+
+func makeFileServer(id *p2p.Identity, trusted []string, listenAddr string, nodes ...string) *fileserver.FileServer {
 	keyPath := fmt.Sprintf("encryption_keys/%s_key", listenAddr)
 
 	if err := os.MkdirAll("encryption_keys", 0755); err != nil {
@@ -41,25 +51,43 @@ func makeFileServer(listenAddr string, nodes ...string) *fileserver.FileServer {
 
 	storagePath := fmt.Sprintf("file_storage/%s_storage", listenAddr)
 
-	tr := p2p.NewTCPTransport(listenAddr, p2p.DefaultHandshakeFunc, p2p.DefaultDecodeFunc, nil)
+	handshake := p2p.NewAuthHandshakeFunc(id, trusted)
+	tr := p2p.NewTCPTransport(listenAddr, handshake, p2p.DefaultDecodeFunc, nil)
 	s := storage.NewStorage(storagePath, storage.DefaultPathTransformFunc)
 
-	fs := fileserver.NewFileServer(tr, s, nodes, encKey)
+	fs := fileserver.NewFileServer(fileserver.FileServerOpts{
+		ID:             id.NodeID(),
+		Transport:      tr,
+		Storage:        s,
+		BootstrapNodes: nodes,
+		EncKey:         encKey,
+		ConflictMode:   fileserver.KeepSiblings,
+	})
 
 	tr.OnPeer = fs.OnPeer
+	tr.OnPeerDisconnect = fs.OnPeerDisconnect
 
 	return fs
 }
 
 func main() {
+	addrs := []string{":9000", ":9001", ":9002"}
+
+	identities := []*p2p.Identity{}
+	trusted := []string{}
+	for _, addr := range addrs {
+		id := loadIdentity(addr)
+		identities = append(identities, id)
+		trusted = append(trusted, id.NodeID())
+	}
+
 	fileservers := []*fileserver.FileServer{}
-	fileservers = append(fileservers, makeFileServer(":9000"))
-	fileservers = append(fileservers, makeFileServer(":9001", ":9000"))
-	fileservers = append(fileservers, makeFileServer(":9002", ":9000", ":9001"))
+	fileservers = append(fileservers, makeFileServer(identities[0], trusted, addrs[0]))
+	fileservers = append(fileservers, makeFileServer(identities[1], trusted, addrs[1], addrs[0]))
+	fileservers = append(fileservers, makeFileServer(identities[2], trusted, addrs[2], addrs[0]))
 
 	for _, fs := range fileservers {
 		go fs.Start()
-		time.Sleep(time.Second * 2)
 	}
 
 	for {
@@ -88,11 +116,16 @@ func main() {
 			fmt.Println("[2] Get file")
 			fmt.Println("[3] Delete file globally")
 			fmt.Println("[4] Delete file locally")
+			fmt.Println("[5] List files")
+			fmt.Println("[6] Show file metadata")
+			fmt.Println("[7] Scrub storage")
+			fmt.Println("[8] List file versions")
+			fmt.Println("[9] Restore file version")
 			fmt.Print("[0] Back to server selection\n> ")
 
 			var opCh int
 			_, err := fmt.Scanln(&opCh)
-			if err != nil || opCh < 0 || opCh > 4 {
+			if err != nil || opCh < 0 || opCh > 9 {
 				fmt.Println("Invalid choice.")
 				continue
 			}
@@ -128,14 +161,27 @@ func main() {
 				fmt.Print("Enter file name: ")
 				fmt.Scanln(&fileName)
 
-				r, err := currFs.Get(fileName)
+				r, err := currFs.Get(fileName, fileserver.WithConflicts())
 				time.Sleep(time.Second * 1)
+				var conflict *fileserver.ConflictError
+				if errors.As(err, &conflict) {
+					fmt.Println("File has conflicting versions, restore one to resolve:")
+					for _, v := range conflict.Versions {
+						if v.Deleted {
+							fmt.Printf("%s\tdeleted\t%s\n", v.Version, v.Modified.Format(time.RFC3339))
+							continue
+						}
+						fmt.Printf("%s\t%d bytes\t%s\n", v.Version, v.Size, v.Modified.Format(time.RFC3339))
+					}
+					continue
+				}
 				if err != nil {
 					fmt.Println("Failed to get file:", err)
 					continue
 				}
 
 				fileData, err := io.ReadAll(r)
+				r.Close()
 				if err != nil {
 					fmt.Println("Failed to file data:", err)
 					continue
@@ -168,6 +214,90 @@ func main() {
 				} else {
 					fmt.Println("File deleted successfully.")
 				}
+
+			case 5:
+				var prefix string
+				fmt.Print("Enter key prefix (empty for all): ")
+				fmt.Scanln(&prefix)
+
+				files, err := currFs.List(prefix)
+				if err != nil {
+					fmt.Println("Failed to list some files:", err)
+				}
+
+				for _, f := range files {
+					fmt.Printf("%s\t%d bytes\t%s\ton %d nodes\n", f.Key, f.Size, f.Modified.Format(time.RFC3339), len(f.Nodes))
+				}
+
+			case 6:
+				var fileName string
+				fmt.Print("Enter file name: ")
+				fmt.Scanln(&fileName)
+
+				meta, err := currFs.Stat(fileName)
+				if err != nil {
+					fmt.Println("Failed to get file metadata:", err)
+					continue
+				}
+
+				fmt.Println("Size:", meta.Size)
+				fmt.Println("SHA-256:", meta.SHA256)
+				fmt.Println("Created:", meta.Created.Format(time.RFC3339))
+				fmt.Println("Modified:", meta.Modified.Format(time.RFC3339))
+				fmt.Println("Owner:", meta.Owner)
+				if meta.ContentType != "" {
+					fmt.Println("Content type:", meta.ContentType)
+				}
+				for name, value := range meta.Attributes {
+					fmt.Printf("%s: %s\n", name, value)
+				}
+
+			case 7:
+				report := currFs.Scrub()
+				if report.Running {
+					fmt.Printf("Scrub already running, %d of %d blobs checked.\n", report.Scanned, report.Blobs)
+				} else {
+					fmt.Printf("Scrubbed %d blobs, %d bytes.\n", report.Scanned, report.Bytes)
+				}
+
+				for _, f := range report.Findings {
+					status := "repaired"
+					if !f.Repaired {
+						status = "not repaired"
+					}
+					fmt.Printf("%s\tquarantined, %s\t%v\n", f.Key, status, f.Err)
+				}
+
+			case 8:
+				var fileName string
+				fmt.Print("Enter file name: ")
+				fmt.Scanln(&fileName)
+
+				versions, err := currFs.Versions(fileName)
+				if err != nil {
+					fmt.Println("Failed to list some versions:", err)
+				}
+
+				for _, v := range versions {
+					if v.Deleted {
+						fmt.Printf("%s\tdeleted\t%s\n", v.Version, v.Modified.Format(time.RFC3339))
+						continue
+					}
+					fmt.Printf("%s\t%d bytes\t%s\n", v.Version, v.Size, v.Modified.Format(time.RFC3339))
+				}
+
+			case 9:
+				var fileName, version string
+				fmt.Print("Enter file name: ")
+				fmt.Scanln(&fileName)
+				fmt.Print("Enter version: ")
+				fmt.Scanln(&version)
+
+				if err := currFs.Restore(fileName, version); err != nil {
+					fmt.Println("Failed to restore file:", err)
+				} else {
+					fmt.Println("File restored successfully.")
+				}
 			}
 		}
 	}
@@ -0,0 +1,29 @@
+package p2p
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff spaces out attempts to reach a peer. The delay starts at Min and
+// doubles after each failed attempt up to Max. Jitter spreads each delay by
+// up to that fraction either way, so peers that lost a node together do not
+// redial it in lockstep.
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Jitter float64
+}
+
+var DefaultBackoff = Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second, Jitter: 0.2}
+
+// Delay returns how long to wait after the given number of failed attempts.
+func (b Backoff) Delay(failures int) time.Duration {
+	d := b.Min
+	for i := 0; i < failures && d < b.Max; i++ {
+		d *= 2
+	}
+	d = min(d, b.Max)
+
+	return d + time.Duration(float64(d)*b.Jitter*(2*rand.Float64()-1))
+}
@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type FrameType uint8
+
+const (
+	FrameMessage FrameType = 0x1
+	FrameOpen    FrameType = 0x2
+	FrameData    FrameType = 0x3
+	FrameWindow  FrameType = 0x4
+	FrameClose   FrameType = 0x5
+	FrameReset   FrameType = 0x6
+	FramePing    FrameType = 0x7
+	FramePong    FrameType = 0x8
+)
+
+const (
+	frameHeaderSize = 9
+	MaxFramePayload = 16 << 20
+)
+
+var ErrFrameTooLarge = errors.New("frame payload exceeds maximum size")
+
+// Frame is the unit written on the wire: a 1 byte type, a 4 byte stream ID
+// and a 4 byte payload length, all big endian, followed by the payload.
+type Frame struct {
+	Type     FrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(f *Frame) error {
+	if len(f.Payload) > MaxFramePayload {
+		return ErrFrameTooLarge
+	}
+
+	buff := make([]byte, frameHeaderSize+len(f.Payload))
+	buff[0] = byte(f.Type)
+	binary.BigEndian.PutUint32(buff[1:5], f.StreamID)
+	binary.BigEndian.PutUint32(buff[5:9], uint32(len(f.Payload)))
+	copy(buff[frameHeaderSize:], f.Payload)
+
+	_, err := e.w.Write(buff)
+	return err
+}
+
+type Decoder struct {
+	r      io.Reader
+	header [frameHeaderSize]byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
+
+func (d *Decoder) Decode(f *Frame) error {
+	if _, err := io.ReadFull(d.r, d.header[:]); err != nil {
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(d.header[5:9])
+	if length > MaxFramePayload {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+
+	f.Type = FrameType(d.header[0])
+	f.StreamID = binary.BigEndian.Uint32(d.header[1:5])
+	f.Payload = make([]byte, length)
+
+	if _, err := io.ReadFull(d.r, f.Payload); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	return nil
+}
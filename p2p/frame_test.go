@@ -0,0 +1,77 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameLargePayload(t *testing.T) {
+	payload := bytes.Repeat([]byte("scatterfs"), 1<<16)
+
+	buff := new(bytes.Buffer)
+	assert.Nil(t, NewEncoder(buff).Encode(&Frame{Type: FrameMessage, Payload: payload}))
+
+	var f Frame
+	assert.Nil(t, DefaultDecodeFunc(iotest.HalfReader(buff), &f))
+	assert.Equal(t, FrameMessage, f.Type)
+	assert.Equal(t, payload, f.Payload)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	header := []byte{byte(FrameMessage), 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff}
+
+	var f Frame
+	assert.ErrorIs(t, NewDecoder(bytes.NewReader(header)).Decode(&f), ErrFrameTooLarge)
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(uint8(FrameMessage), uint32(0), []byte("hello"))
+	f.Add(uint8(FrameData), uint32(7), []byte{})
+	f.Add(uint8(FrameMessage), uint32(1), bytes.Repeat([]byte{0xab}, 4096))
+
+	f.Fuzz(func(t *testing.T, typ uint8, streamID uint32, payload []byte) {
+		buff := new(bytes.Buffer)
+		enc := NewEncoder(buff)
+
+		in := Frame{Type: FrameType(typ), StreamID: streamID, Payload: payload}
+		if err := enc.Encode(&in); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(&in); err != nil {
+			t.Fatal(err)
+		}
+
+		dec := NewDecoder(iotest.OneByteReader(buff))
+		for i := 0; i < 2; i++ {
+			var out Frame
+			if err := dec.Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.Type != in.Type || out.StreamID != in.StreamID || !bytes.Equal(out.Payload, in.Payload) {
+				t.Fatalf("frame mismatch: got %+v, want %+v", out, in)
+			}
+		}
+
+		if buff.Len() != 0 {
+			t.Fatalf("%d trailing bytes left after decoding", buff.Len())
+		}
+	})
+}
+
+func FuzzFrameDecode(f *testing.F) {
+	f.Add([]byte{byte(FrameMessage), 0, 0, 0, 1, 0, 0, 0, 2, 'h', 'i'})
+	f.Add([]byte{byte(FrameOpen), 0, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var out Frame
+		if err := NewDecoder(bytes.NewReader(data)).Decode(&out); err != nil {
+			return
+		}
+		if len(out.Payload) > len(data)-frameHeaderSize {
+			t.Fatalf("decoded %d payload bytes from %d input bytes", len(out.Payload), len(data))
+		}
+	})
+}
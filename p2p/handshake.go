@@ -1,5 +1,242 @@
 package p2p
 
-type HandshakeFunc func(Peer) error
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"time"
+)
 
-func DefaultHandshakeFunc(Peer) error { return nil }
+type HandshakeFunc func(*TCPPeer) error
+
+// DefaultHandshakeFunc identifies both sides to each other, unauthenticated
+// and in the clear: each sends the node ID it goes by, its transport's
+// NodeID, and the address it listens on.
+func DefaultHandshakeFunc(p *TCPPeer) error {
+	p.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer p.Conn.SetDeadline(time.Time{})
+
+	remoteID, err := exchangeString(p.Conn, p.localID)
+	if err != nil {
+		return fmt.Errorf("exchanging node IDs: %w", err)
+	}
+	if remoteID != "" && remoteID == p.localID {
+		return errors.New("refusing connection to self")
+	}
+
+	listenAddr, err := exchangeString(p.Conn, p.advertise)
+	if err != nil {
+		return fmt.Errorf("exchanging listen addresses: %w", err)
+	}
+
+	p.id = remoteID
+	p.listenAddr = resolveAdvertised(listenAddr, p.Conn.RemoteAddr())
+
+	return nil
+}
+
+const (
+	handshakeTimeout = time.Second * 10
+	handshakeVersion = 3
+	handshakeContext = "scatterfs handshake v3"
+	nonceSize        = 32
+	ephemeralSize    = 32
+	helloSize        = 4 + 1 + ed25519.PublicKeySize + ephemeralSize + nonceSize
+)
+
+var (
+	handshakeMagic = []byte("SFSH")
+
+	ErrUntrustedPeer = errors.New("peer is not in the allowlist")
+	ErrBadSignature  = errors.New("peer handshake signature is invalid")
+)
+
+// NewAuthHandshakeFunc returns a handshake in which both sides prove
+// ownership of their Ed25519 identity by signing a transcript of both
+// hellos. If trusted is non-empty, only the listed node IDs are accepted.
+// The hellos also carry ephemeral X25519 keys, and once the signatures check
+// out the peer connection is switched to an encrypted session keyed from
+// their shared secret, over which both sides tell each other the address
+// they listen on.
+func NewAuthHandshakeFunc(id *Identity, trusted []string) HandshakeFunc {
+	allow := make(map[string]bool, len(trusted))
+	for _, nodeID := range trusted {
+		allow[nodeID] = true
+	}
+
+	return func(p *TCPPeer) error {
+		p.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		defer p.Conn.SetDeadline(time.Time{})
+
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		hello := make([]byte, 0, helloSize)
+		hello = append(hello, handshakeMagic...)
+		hello = append(hello, handshakeVersion)
+		hello = append(hello, id.PublicKey()...)
+		hello = append(hello, ephemeral.PublicKey().Bytes()...)
+		nonce := make([]byte, nonceSize)
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		hello = append(hello, nonce...)
+
+		remoteHello, err := exchange(p.Conn, hello, helloSize)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(remoteHello[:4], handshakeMagic) {
+			return errors.New("peer did not send a scatterfs hello")
+		}
+		if remoteHello[4] != handshakeVersion {
+			return fmt.Errorf("unsupported handshake version %d", remoteHello[4])
+		}
+
+		remoteKey := ed25519.PublicKey(remoteHello[5 : 5+ed25519.PublicKeySize])
+		remoteID := NodeIDFromKey(remoteKey)
+		if remoteID == id.NodeID() {
+			return errors.New("refusing connection to self")
+		}
+		if len(allow) > 0 && !allow[remoteID] {
+			return fmt.Errorf("%w: %s", ErrUntrustedPeer, remoteID)
+		}
+
+		dialerHello, listenerHello := hello, remoteHello
+		if p.incoming {
+			dialerHello, listenerHello = remoteHello, hello
+		}
+		transcript := func(incoming bool) []byte {
+			role := byte('D')
+			if incoming {
+				role = 'L'
+			}
+			b := append([]byte(handshakeContext), role)
+			b = append(b, dialerHello...)
+			return append(b, listenerHello...)
+		}
+
+		sig, err := exchange(p.Conn, id.Sign(transcript(p.incoming)), ed25519.SignatureSize)
+		if err != nil {
+			return err
+		}
+		if !ed25519.Verify(remoteKey, transcript(!p.incoming), sig) {
+			return ErrBadSignature
+		}
+
+		ephOffset := 5 + ed25519.PublicKeySize
+		remoteEphemeral, err := ecdh.X25519().NewPublicKey(remoteHello[ephOffset : ephOffset+ephemeralSize])
+		if err != nil {
+			return err
+		}
+		secret, err := ephemeral.ECDH(remoteEphemeral)
+		if err != nil {
+			return err
+		}
+
+		dialerKey, listenerKey, err := deriveSessionKeys(secret, transcript(false))
+		if err != nil {
+			return err
+		}
+		sendKey, recvKey := dialerKey, listenerKey
+		if p.incoming {
+			sendKey, recvKey = listenerKey, dialerKey
+		}
+
+		conn, err := newSecureConn(p.Conn, sendKey, recvKey)
+		if err != nil {
+			return err
+		}
+
+		p.Conn = conn
+		p.id = remoteID
+		p.localID = id.NodeID()
+
+		listenAddr, err := exchangeString(conn, p.advertise)
+		if err != nil {
+			return fmt.Errorf("exchanging listen addresses: %w", err)
+		}
+		p.listenAddr = resolveAdvertised(listenAddr, conn.RemoteAddr())
+
+		return nil
+	}
+}
+
+// exchangeString sends s, length prefixed, while reading the remote's, so
+// like exchange it works on unbuffered connections.
+func exchangeString(conn net.Conn, s string) (string, error) {
+	if len(s) > math.MaxUint16 {
+		return "", fmt.Errorf("string too long: %d bytes", len(s))
+	}
+
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(s)))
+	out = append(out, s...)
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(out)
+		errChan <- err
+	}()
+
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return "", err
+	}
+	in := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return "", err
+	}
+
+	if err := <-errChan; err != nil {
+		return "", err
+	}
+
+	return string(in), nil
+}
+
+// resolveAdvertised fills in the host of an advertised address that has none
+// or an unspecified one, such as ":9000", with the host the connection came
+// from.
+func resolveAdvertised(addr string, remote net.Addr) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	tcp, ok := remote.(*net.TCPAddr)
+	if !ok || hasHost(addr) {
+		return addr
+	}
+
+	return net.JoinHostPort(tcp.IP.String(), port)
+}
+
+// exchange writes out while concurrently reading n bytes from the remote,
+// so it works on unbuffered connections where both sides write first.
+func exchange(conn net.Conn, out []byte, n int) ([]byte, error) {
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(out)
+		errChan <- err
+	}()
+
+	in := make([]byte, n)
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return nil, err
+	}
+
+	if err := <-errChan; err != nil {
+		return nil, err
+	}
+
+	return in, nil
+}
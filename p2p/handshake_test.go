@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakePair(t *testing.T, a, b HandshakeFunc) (*TCPPeer, *TCPPeer, error, error) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	dialer := NewTCPPeer(c1, false)
+	dialer.localID = "node-a"
+	dialer.advertise = "10.0.0.1:9000"
+	listener := NewTCPPeer(c2, true)
+	listener.localID = "node-b"
+	listener.advertise = "10.0.0.2:9001"
+
+	errChan := make(chan error)
+	go func() {
+		err := b(listener)
+		if err != nil {
+			c2.Close()
+		}
+		errChan <- err
+	}()
+
+	errA := a(dialer)
+	if errA != nil {
+		c1.Close()
+	}
+
+	return dialer, listener, errA, <-errChan
+}
+
+func TestAuthHandshake(t *testing.T) {
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+
+	trusted := []string{idA.NodeID(), idB.NodeID()}
+	dialer, listener, errA, errB := handshakePair(t,
+		NewAuthHandshakeFunc(idA, trusted),
+		NewAuthHandshakeFunc(idB, trusted),
+	)
+
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, idB.NodeID(), dialer.ID())
+	assert.Equal(t, idA.NodeID(), listener.ID())
+	assert.Equal(t, "10.0.0.2:9001", dialer.ListenAddr())
+	assert.Equal(t, "10.0.0.1:9000", listener.ListenAddr())
+}
+
+func TestDefaultHandshake(t *testing.T) {
+	dialer, listener, errA, errB := handshakePair(t, DefaultHandshakeFunc, DefaultHandshakeFunc)
+
+	assert.Nil(t, errA)
+	assert.Nil(t, errB)
+	assert.Equal(t, "node-b", dialer.ID())
+	assert.Equal(t, "node-a", listener.ID())
+	assert.Equal(t, "10.0.0.2:9001", dialer.ListenAddr())
+	assert.Equal(t, "10.0.0.1:9000", listener.ListenAddr())
+}
+
+func TestResolveAdvertised(t *testing.T) {
+	remote := &net.TCPAddr{IP: net.ParseIP("192.168.1.7"), Port: 54321}
+
+	assert.Equal(t, "192.168.1.7:9000", resolveAdvertised(":9000", remote))
+	assert.Equal(t, "192.168.1.7:9000", resolveAdvertised("0.0.0.0:9000", remote))
+	assert.Equal(t, "10.0.0.1:9000", resolveAdvertised("10.0.0.1:9000", remote))
+	assert.Equal(t, "node1:9000", resolveAdvertised("node1:9000", remote))
+}
+
+func TestAuthHandshakeRejectsUntrusted(t *testing.T) {
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	intruder, _ := NewIdentity()
+
+	_, _, _, errB := handshakePair(t,
+		NewAuthHandshakeFunc(intruder, nil),
+		NewAuthHandshakeFunc(idB, []string{idA.NodeID(), idB.NodeID()}),
+	)
+
+	assert.ErrorIs(t, errB, ErrUntrustedPeer)
+}
+
+func TestAuthHandshakeRejectsPlainPeer(t *testing.T) {
+	id, _ := NewIdentity()
+
+	_, _, errA, _ := handshakePair(t,
+		NewAuthHandshakeFunc(id, nil),
+		func(p *TCPPeer) error {
+			_, err := exchange(p.Conn, make([]byte, helloSize), helloSize)
+			return err
+		},
+	)
+
+	assert.NotNil(t, errA)
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "node_id")
+
+	id, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+
+	loaded, err := LoadOrCreateIdentity(path)
+	assert.Nil(t, err)
+	assert.Equal(t, id.NodeID(), loaded.NodeID())
+}
@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+type Identity struct {
+	privateKey ed25519.PrivateKey
+}
+
+func NewIdentity() (*Identity, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{privateKey: priv}, nil
+}
+
+// LoadOrCreateIdentity reads the Ed25519 seed stored at path, generating and
+// persisting a new one if the file does not exist yet.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("identity file %s has invalid size %d", path, len(seed))
+		}
+		return &Identity{privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	id, err := NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, id.privateKey.Seed(), 0600); err != nil {
+		return nil, err
+	}
+
+	return id, nil
+}
+
+func (id *Identity) PublicKey() ed25519.PublicKey {
+	return id.privateKey.Public().(ed25519.PublicKey)
+}
+
+func (id *Identity) NodeID() string {
+	return NodeIDFromKey(id.PublicKey())
+}
+
+func (id *Identity) Sign(b []byte) []byte {
+	return ed25519.Sign(id.privateKey, b)
+}
+
+func NodeIDFromKey(pub ed25519.PublicKey) string {
+	digest := sha256.Sum256(pub)
+	return hex.EncodeToString(digest[:16])
+}
@@ -0,0 +1,543 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/gob"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultProbeInterval  = time.Second
+	DefaultProbeTimeout   = time.Millisecond * 500
+	DefaultSuspectTimeout = time.Second * 5
+	DefaultIndirectProbes = 3
+
+	// retransmitMult scales how many times an update is piggybacked,
+	// relative to the log of the cluster size.
+	retransmitMult = 3
+)
+
+// MemberState is what the cluster believes about a member.
+type MemberState uint8
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+	MemberLeft
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+
+	return "left"
+}
+
+// Member is a node of the cluster as gossip describes it. Only the member
+// itself raises its Incarnation, which it does to refute rumours of its
+// failure, so a higher incarnation always means fresher news.
+type Member struct {
+	ID          string
+	Addr        string
+	State       MemberState
+	Incarnation uint64
+}
+
+func (m Member) live() bool {
+	return m.State == MemberAlive || m.State == MemberSuspect
+}
+
+// supersedes reports whether m is newer news about a member than other.
+// Within an incarnation, suspicion overrides liveness and a failure or a
+// departure overrides both.
+func (m Member) supersedes(other Member) bool {
+	if m.Incarnation != other.Incarnation {
+		return m.Incarnation > other.Incarnation
+	}
+
+	return m.State > other.State
+}
+
+type gossipType uint8
+
+const (
+	gossipPing gossipType = iota
+	gossipAck
+	gossipPingReq
+	// gossipSync carries the sender's whole member list and asks for the
+	// receiver's in return; gossipPush carries updates and wants no reply.
+	gossipSync
+	gossipPush
+)
+
+type gossipMessage struct {
+	Type    gossipType
+	Seq     uint64
+	Target  string
+	Members []Member
+}
+
+type MembershipOpts struct {
+	// ID and Addr identify this node to the cluster: Addr is where other
+	// members dial it.
+	ID   string
+	Addr string
+	// Send delivers a gossip payload to the member with the given ID, whose
+	// Handle must then be called with it.
+	Send func(id string, payload []byte) error
+	// PeerAddr returns the address the member id advertised when it
+	// connected, or "" if it is not connected. News a member sends about
+	// itself carries that address rather than Addr, which may lack a host.
+	PeerAddr func(id string) string
+	// OnJoin is called when a member comes alive, and OnLeave when it is
+	// declared dead or leaves.
+	OnJoin  func(Member)
+	OnLeave func(Member)
+	// ProbeInterval is how often a member is probed, and ProbeTimeout how
+	// long each direct and indirect probe waits for an ack.
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// SuspectTimeout is how long a suspect member has to refute the
+	// suspicion before it is declared dead.
+	SuspectTimeout time.Duration
+	// IndirectProbes is how many members are asked to probe a member that
+	// failed to answer directly.
+	IndirectProbes int
+}
+
+type broadcast struct {
+	member Member
+	sent   int
+}
+
+// Membership tracks the members of the cluster with a SWIM-style protocol:
+// each round it pings one member, asks others to ping it on its behalf if it
+// does not answer, and suspects it if nobody can reach it. Suspects that do
+// not refute in time are declared dead. Changes spread by piggybacking on
+// the pings and acks, and a joining node swaps member lists with a single
+// seed.
+type Membership struct {
+	opts MembershipOpts
+
+	lock       sync.Mutex
+	members    map[string]*Member
+	broadcasts map[string]*broadcast
+	probeOrder []string
+
+	pendingLock sync.Mutex
+	pending     map[uint64]chan struct{}
+	seq         atomic.Uint64
+
+	quitChan chan struct{}
+	stopOnce sync.Once
+}
+
+func NewMembership(opts MembershipOpts) *Membership {
+	if opts.ProbeInterval <= 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout <= 0 {
+		opts.ProbeTimeout = min(DefaultProbeTimeout, opts.ProbeInterval/2)
+	}
+	if opts.SuspectTimeout <= 0 {
+		opts.SuspectTimeout = DefaultSuspectTimeout
+	}
+	if opts.IndirectProbes <= 0 {
+		opts.IndirectProbes = DefaultIndirectProbes
+	}
+
+	self := &Member{ID: opts.ID, Addr: opts.Addr, State: MemberAlive}
+
+	return &Membership{
+		opts:       opts,
+		members:    map[string]*Member{self.ID: self},
+		broadcasts: make(map[string]*broadcast),
+		pending:    make(map[uint64]chan struct{}),
+		quitChan:   make(chan struct{}),
+	}
+}
+
+// Members returns the live members, this node included, sorted by ID.
+func (ms *Membership) Members() []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	members := []Member{}
+	for _, m := range ms.members {
+		if m.live() {
+			members = append(members, *m)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+
+	return members
+}
+
+// Start probes members every ProbeInterval until Stop is called.
+func (ms *Membership) Start() {
+	ticker := time.NewTicker(ms.opts.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ms.probeRound()
+		case <-ms.quitChan:
+			return
+		}
+	}
+}
+
+func (ms *Membership) Stop() {
+	ms.stopOnce.Do(func() { close(ms.quitChan) })
+}
+
+// Join swaps member lists with the member id, which is all a new node
+// needs to learn the cluster from a single seed.
+func (ms *Membership) Join(id string) error {
+	return ms.send(id, gossipMessage{Type: gossipSync, Members: ms.snapshot()})
+}
+
+// Leave tells the live members this node is leaving, so they drop it at
+// once rather than after suspecting it.
+func (ms *Membership) Leave() {
+	ms.lock.Lock()
+	self := ms.members[ms.opts.ID]
+	self.State = MemberLeft
+	ms.queue(*self)
+	ids := ms.liveIDs()
+	ms.lock.Unlock()
+
+	for _, id := range ids {
+		ms.send(id, gossipMessage{Type: gossipPush})
+	}
+}
+
+// Handle processes a gossip payload received from the member from.
+func (ms *Membership) Handle(from string, payload []byte) error {
+	var msg gossipMessage
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&msg); err != nil {
+		return err
+	}
+
+	if ms.opts.PeerAddr != nil {
+		if addr := ms.opts.PeerAddr(from); addr != "" {
+			for i := range msg.Members {
+				if msg.Members[i].ID == from {
+					msg.Members[i].Addr = addr
+				}
+			}
+		}
+	}
+	ms.merge(msg.Members)
+
+	switch msg.Type {
+	case gossipPing:
+		return ms.send(from, gossipMessage{Type: gossipAck, Seq: msg.Seq})
+	case gossipAck:
+		ms.ack(msg.Seq)
+	case gossipPingReq:
+		go func() {
+			if ms.probe(msg.Target) {
+				ms.send(from, gossipMessage{Type: gossipAck, Seq: msg.Seq})
+			}
+		}()
+	case gossipSync:
+		return ms.send(from, gossipMessage{Type: gossipPush, Members: ms.snapshot()})
+	}
+
+	return nil
+}
+
+// send piggybacks pending updates on msg and hands it to Send.
+func (ms *Membership) send(id string, msg gossipMessage) error {
+	ms.lock.Lock()
+	msg.Members = append(msg.Members, ms.piggyback()...)
+	ms.lock.Unlock()
+
+	buff := new(bytes.Buffer)
+	if err := gob.NewEncoder(buff).Encode(msg); err != nil {
+		return err
+	}
+
+	return ms.opts.Send(id, buff.Bytes())
+}
+
+func (ms *Membership) snapshot() []Member {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	members := make([]Member, 0, len(ms.members))
+	for _, m := range ms.members {
+		members = append(members, *m)
+	}
+
+	return members
+}
+
+// liveIDs returns the live members other than this node. The caller holds
+// lock.
+func (ms *Membership) liveIDs() []string {
+	ids := []string{}
+	for id, m := range ms.members {
+		if id != ms.opts.ID && m.live() {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// queue schedules an update to be piggybacked, replacing older news about
+// the same member. The caller holds lock.
+func (ms *Membership) queue(m Member) {
+	ms.broadcasts[m.ID] = &broadcast{member: m}
+}
+
+// piggyback returns the queued updates, dropping those sent often enough to
+// have reached every member with high probability. The caller holds lock.
+func (ms *Membership) piggyback() []Member {
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(ms.members)+1))))
+
+	updates := []Member{}
+	for id, b := range ms.broadcasts {
+		updates = append(updates, b.member)
+		if b.sent++; b.sent >= limit {
+			delete(ms.broadcasts, id)
+		}
+	}
+
+	return updates
+}
+
+func (ms *Membership) merge(updates []Member) {
+	var events []func()
+
+	ms.lock.Lock()
+	for _, u := range updates {
+		events = append(events, ms.apply(u)...)
+	}
+	ms.lock.Unlock()
+
+	for _, event := range events {
+		event()
+	}
+}
+
+// apply merges an update about a member into the local view, returning the
+// callbacks it triggers for the caller to run once it releases lock.
+func (ms *Membership) apply(u Member) []func() {
+	if u.ID == ms.opts.ID {
+		// Rumours of this node's failure are refuted by outbidding them.
+		self := ms.members[u.ID]
+		if self.State == MemberAlive && u.State != MemberAlive && u.Incarnation >= self.Incarnation {
+			self.Incarnation = u.Incarnation + 1
+			ms.queue(*self)
+		}
+		return nil
+	}
+
+	cur, ok := ms.members[u.ID]
+	if ok && !u.supersedes(*cur) {
+		return nil
+	}
+	if ok && !hasHost(u.Addr) {
+		u.Addr = cur.Addr
+	}
+	wasLive := ok && cur.live()
+	ms.members[u.ID] = &u
+	ms.queue(u)
+
+	if u.State == MemberSuspect {
+		time.AfterFunc(ms.opts.SuspectTimeout, func() { ms.expireSuspect(u) })
+	}
+
+	switch {
+	case u.live() && !wasLive:
+		log.Printf("[%s] member %s (%s) joined", ms.opts.Addr, u.ID, u.Addr)
+		if ms.opts.OnJoin != nil {
+			return []func(){func() { ms.opts.OnJoin(u) }}
+		}
+	case !u.live() && wasLive:
+		log.Printf("[%s] member %s (%s) is %s", ms.opts.Addr, u.ID, u.Addr, u.State)
+		if ms.opts.OnLeave != nil {
+			return []func(){func() { ms.opts.OnLeave(u) }}
+		}
+	}
+
+	return nil
+}
+
+// hasHost reports whether addr names a host to dial, unlike ":9000" or
+// "0.0.0.0:9000".
+func hasHost(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && !net.ParseIP(host).IsUnspecified()
+}
+
+// expireSuspect declares a suspect dead unless it has refuted the suspicion
+// since.
+func (ms *Membership) expireSuspect(suspect Member) {
+	select {
+	case <-ms.quitChan:
+		return
+	default:
+	}
+
+	ms.lock.Lock()
+	cur := ms.members[suspect.ID]
+	if cur.State != MemberSuspect || cur.Incarnation != suspect.Incarnation {
+		ms.lock.Unlock()
+		return
+	}
+	dead := suspect
+	dead.State = MemberDead
+	events := ms.apply(dead)
+	ms.lock.Unlock()
+
+	for _, event := range events {
+		event()
+	}
+}
+
+// nextTarget picks the member to probe, going round the live members in a
+// random order that is reshuffled after every pass.
+func (ms *Membership) nextTarget() (Member, bool) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(ms.probeOrder) > 0 {
+			id := ms.probeOrder[0]
+			ms.probeOrder = ms.probeOrder[1:]
+			if m, ok := ms.members[id]; ok && m.live() {
+				return *m, true
+			}
+		}
+
+		ms.probeOrder = ms.liveIDs()
+		rand.Shuffle(len(ms.probeOrder), func(i, j int) {
+			ms.probeOrder[i], ms.probeOrder[j] = ms.probeOrder[j], ms.probeOrder[i]
+		})
+	}
+
+	return Member{}, false
+}
+
+func (ms *Membership) probeRound() {
+	target, ok := ms.nextTarget()
+	if !ok || ms.probe(target.ID) || ms.probeIndirect(target.ID) {
+		return
+	}
+
+	ms.lock.Lock()
+	var events []func()
+	if cur := ms.members[target.ID]; cur.State == MemberAlive && cur.Incarnation == target.Incarnation {
+		suspect := *cur
+		suspect.State = MemberSuspect
+		events = ms.apply(suspect)
+	}
+	ms.lock.Unlock()
+
+	for _, event := range events {
+		event()
+	}
+}
+
+func (ms *Membership) newPending() (uint64, chan struct{}) {
+	seq := ms.seq.Add(1)
+	ch := make(chan struct{}, 1)
+
+	ms.pendingLock.Lock()
+	ms.pending[seq] = ch
+	ms.pendingLock.Unlock()
+
+	return seq, ch
+}
+
+func (ms *Membership) closePending(seq uint64) {
+	ms.pendingLock.Lock()
+	delete(ms.pending, seq)
+	ms.pendingLock.Unlock()
+}
+
+func (ms *Membership) ack(seq uint64) {
+	ms.pendingLock.Lock()
+	ch, ok := ms.pending[seq]
+	ms.pendingLock.Unlock()
+
+	if ok {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (ms *Membership) await(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	case <-time.After(ms.opts.ProbeTimeout):
+		return false
+	case <-ms.quitChan:
+		return false
+	}
+}
+
+// probe pings the member id directly and reports whether it acked in time.
+func (ms *Membership) probe(id string) bool {
+	seq, ch := ms.newPending()
+	defer ms.closePending(seq)
+
+	if err := ms.send(id, gossipMessage{Type: gossipPing, Seq: seq}); err != nil {
+		return false
+	}
+
+	return ms.await(ch)
+}
+
+// probeIndirect asks up to IndirectProbes other members to ping id, which
+// tells a failed member apart from a bad link between it and this node.
+func (ms *Membership) probeIndirect(id string) bool {
+	ms.lock.Lock()
+	helpers := ms.liveIDs()
+	ms.lock.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+
+	seq, ch := ms.newPending()
+	defer ms.closePending(seq)
+
+	asked := 0
+	for _, helper := range helpers {
+		if asked == ms.opts.IndirectProbes {
+			break
+		}
+		if helper == id {
+			continue
+		}
+		if err := ms.send(helper, gossipMessage{Type: gossipPingReq, Seq: seq, Target: id}); err == nil {
+			asked++
+		}
+	}
+	if asked == 0 {
+		return false
+	}
+
+	return ms.await(ch)
+}
@@ -0,0 +1,172 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memNetwork delivers gossip between memberships in memory, and can cut
+// members off to simulate failures. It records the departures each member
+// sees. Members advertise addresses without a host, which PeerAddr fills in
+// the way the handshake does.
+type memNetwork struct {
+	lock    sync.Mutex
+	members map[string]*Membership
+	down    map[string]bool
+	left    map[string][]Member
+}
+
+func newMemNetwork(t *testing.T, n int) (*memNetwork, []*Membership) {
+	net := &memNetwork{
+		members: make(map[string]*Membership),
+		down:    make(map[string]bool),
+		left:    make(map[string][]Member),
+	}
+
+	list := []*Membership{}
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("node%d", i)
+		ms := NewMembership(MembershipOpts{
+			ID:       id,
+			Addr:     fmt.Sprintf(":%d", 9000+i),
+			Send:     net.sender(id),
+			PeerAddr: memPeerAddr,
+			OnLeave: func(m Member) {
+				net.lock.Lock()
+				net.left[id] = append(net.left[id], m)
+				net.lock.Unlock()
+			},
+			ProbeInterval:  20 * time.Millisecond,
+			SuspectTimeout: 200 * time.Millisecond,
+		})
+		net.members[id] = ms
+		list = append(list, ms)
+
+		go ms.Start()
+		t.Cleanup(ms.Stop)
+	}
+
+	return net, list
+}
+
+func memPeerAddr(id string) string {
+	var i int
+	fmt.Sscanf(id, "node%d", &i)
+
+	return fmt.Sprintf("10.0.0.%d:%d", i, 9000+i)
+}
+
+func (n *memNetwork) sender(from string) func(string, []byte) error {
+	return func(to string, payload []byte) error {
+		n.lock.Lock()
+		target, ok := n.members[to]
+		cut := n.down[from] || n.down[to]
+		n.lock.Unlock()
+
+		if !ok || cut {
+			return errors.New("unreachable")
+		}
+		go target.Handle(from, payload)
+
+		return nil
+	}
+}
+
+func (n *memNetwork) departures(id string) []Member {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.left[id]
+}
+
+func (n *memNetwork) setDown(id string, down bool) {
+	n.lock.Lock()
+	n.down[id] = down
+	n.lock.Unlock()
+}
+
+func waitForMembers(t *testing.T, ms *Membership, n int) {
+	assert.Eventually(t, func() bool {
+		return len(ms.Members()) == n
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMembershipJoinThroughSeed(t *testing.T) {
+	_, members := newMemNetwork(t, 4)
+
+	// Every node joins through the first one only.
+	for _, ms := range members[1:] {
+		assert.Nil(t, ms.Join(members[0].opts.ID))
+	}
+
+	for _, ms := range members {
+		waitForMembers(t, ms, 4)
+	}
+}
+
+func TestMembershipResolvesAddresses(t *testing.T) {
+	_, members := newMemNetwork(t, 3)
+	for _, ms := range members[1:] {
+		assert.Nil(t, ms.Join(members[0].opts.ID))
+	}
+
+	for _, ms := range members {
+		waitForMembers(t, ms, 3)
+		for _, m := range ms.Members() {
+			if m.ID != ms.opts.ID {
+				assert.Equal(t, memPeerAddr(m.ID), m.Addr)
+			}
+		}
+	}
+}
+
+func TestMembershipDetectsFailure(t *testing.T) {
+	net, members := newMemNetwork(t, 3)
+	a, b, c := members[0], members[1], members[2]
+
+	assert.Nil(t, b.Join(a.opts.ID))
+	assert.Nil(t, c.Join(a.opts.ID))
+	for _, ms := range members {
+		waitForMembers(t, ms, 3)
+	}
+
+	net.setDown(c.opts.ID, true)
+	for _, ms := range []*Membership{a, b} {
+		waitForMembers(t, ms, 2)
+		if left := net.departures(ms.opts.ID); assert.Len(t, left, 1) {
+			assert.Equal(t, c.opts.ID, left[0].ID)
+			assert.Equal(t, MemberDead, left[0].State)
+		}
+	}
+
+	// Back on the network, c refutes its death and rejoins.
+	net.setDown(c.opts.ID, false)
+	assert.Nil(t, c.Join(a.opts.ID))
+	for _, ms := range members {
+		waitForMembers(t, ms, 3)
+	}
+}
+
+func TestMembershipLeave(t *testing.T) {
+	net, members := newMemNetwork(t, 3)
+	a, b, c := members[0], members[1], members[2]
+
+	assert.Nil(t, b.Join(a.opts.ID))
+	assert.Nil(t, c.Join(a.opts.ID))
+	for _, ms := range members {
+		waitForMembers(t, ms, 3)
+	}
+
+	c.Leave()
+	for _, ms := range []*Membership{a, b} {
+		waitForMembers(t, ms, 2)
+		if left := net.departures(ms.opts.ID); assert.Len(t, left, 1) {
+			assert.Equal(t, MemberLeft, left[0].State)
+		}
+	}
+}
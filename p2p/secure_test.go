@@ -0,0 +1,139 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sniffer struct {
+	mu       sync.Mutex
+	captured bytes.Buffer
+}
+
+func (s *sniffer) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.captured.Write(b)
+}
+
+func (s *sniffer) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return bytes.Clone(s.captured.Bytes())
+}
+
+// sniffedPeers connects two peers over loopback TCP through a relay that
+// records every byte in both directions. If tamper is set, it is handed each
+// chunk flowing from the dialer to the listener along with its offset.
+func sniffedPeers(t *testing.T, tamper func(offset int, b []byte)) (*TCPPeer, *TCPPeer, *sniffer) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	sniff := &sniffer{}
+	go func() {
+		in, err := relay.Accept()
+		if err != nil {
+			return
+		}
+		out, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+
+		relayCopy := func(dst, src net.Conn, tamper func(int, []byte)) {
+			buff := make([]byte, 4096)
+			offset := 0
+			for {
+				n, err := src.Read(buff)
+				if n > 0 {
+					sniff.Write(buff[:n])
+					if tamper != nil {
+						tamper(offset, buff[:n])
+					}
+					offset += n
+					dst.Write(buff[:n])
+				}
+				if err != nil {
+					dst.Close()
+					return
+				}
+			}
+		}
+		go relayCopy(out, in, tamper)
+		go relayCopy(in, out, nil)
+	}()
+
+	dialConn, err := net.Dial("tcp", relay.Addr().String())
+	assert.Nil(t, err)
+	listenConn, err := ln.Accept()
+	assert.Nil(t, err)
+
+	t.Cleanup(func() {
+		dialConn.Close()
+		listenConn.Close()
+		ln.Close()
+		relay.Close()
+	})
+
+	idA, _ := NewIdentity()
+	idB, _ := NewIdentity()
+	dialer := NewTCPPeer(dialConn, false)
+	listener := NewTCPPeer(listenConn, true)
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- NewAuthHandshakeFunc(idB, nil)(listener)
+	}()
+	assert.Nil(t, NewAuthHandshakeFunc(idA, nil)(dialer))
+	assert.Nil(t, <-errChan)
+
+	return dialer, listener, sniff
+}
+
+func TestSecureSessionHidesPlaintext(t *testing.T) {
+	dialer, listener, sniff := sniffedPeers(t, nil)
+
+	secret := bytes.Repeat([]byte("top secret file contents "), 8000)
+	go func() {
+		dialer.Send(secret)
+		listener.Send(secret)
+	}()
+
+	for _, p := range []*TCPPeer{listener, dialer} {
+		var f Frame
+		assert.Nil(t, NewDecoder(p.Conn).Decode(&f))
+		assert.Equal(t, secret, f.Payload)
+	}
+
+	captured := sniff.Bytes()
+	assert.Greater(t, len(captured), len(secret)*2)
+	assert.False(t, bytes.Contains(captured, []byte("top secret")))
+}
+
+func TestSecureSessionDetectsTampering(t *testing.T) {
+	// Flip a byte inside the first record sent after the handshake, which
+	// follows the record carrying the empty listen address: its two length
+	// bytes and the GCM tag.
+	addrRecord := recordHeaderSize + 2 + 16
+	target := helloSize + 64 + addrRecord + recordHeaderSize + 1
+	dialer, listener, _ := sniffedPeers(t, func(offset int, b []byte) {
+		if target >= offset && target < offset+len(b) {
+			b[target-offset] ^= 0xff
+		}
+	})
+
+	go dialer.Send(bytes.Repeat([]byte("x"), 4096))
+
+	_, err := io.ReadAll(listener.Conn)
+	assert.ErrorIs(t, err, ErrRecordAuth)
+}
@@ -0,0 +1,224 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	streamWindow   = 256 << 10
+	maxDataPayload = 32 << 10
+)
+
+// streamAcceptTimeout is how long a stream the remote opened may wait to be
+// accepted before it is reset.
+var streamAcceptTimeout = time.Second * 30
+
+var (
+	ErrStreamClosed   = errors.New("stream closed")
+	ErrStreamReset    = errors.New("stream reset by remote")
+	ErrStreamNotFound = errors.New("stream not found")
+)
+
+// Stream is a logical, flow controlled substream of a TCPPeer connection.
+// Either side may open a stream; closing it from either side ends it for both.
+type Stream struct {
+	id   uint32
+	peer *TCPPeer
+	// accepted is set, under the peer's streamLock, once a remotely opened
+	// stream is claimed with AcceptStream.
+	accepted bool
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	buff         bytes.Buffer
+	consumed     int
+	credit       int
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newStream(id uint32, peer *TCPPeer) *Stream {
+	st := &Stream{
+		id:     id,
+		peer:   peer,
+		credit: streamWindow,
+	}
+	st.cond = sync.NewCond(&st.mu)
+	return st
+}
+
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	st.mu.Lock()
+	for st.buff.Len() == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+		st.cond.Wait()
+	}
+
+	if st.buff.Len() > 0 {
+		n, _ := st.buff.Read(b)
+		st.consumed += n
+		update := 0
+		if st.consumed >= streamWindow/2 && !st.localClosed {
+			update = st.consumed
+			st.consumed = 0
+		}
+		st.mu.Unlock()
+
+		if update > 0 {
+			payload := make([]byte, 4)
+			binary.BigEndian.PutUint32(payload, uint32(update))
+			if err := st.peer.writeFrame(&Frame{Type: FrameWindow, StreamID: st.id, Payload: payload}); err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+	defer st.mu.Unlock()
+
+	switch {
+	case st.localClosed:
+		return 0, ErrStreamClosed
+	case st.remoteClosed:
+		return 0, io.EOF
+	default:
+		return 0, st.err
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		for st.credit == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		if err := st.writeErr(); err != nil {
+			st.mu.Unlock()
+			return written, err
+		}
+
+		n := min(len(b)-written, st.credit, maxDataPayload)
+		st.credit -= n
+		st.mu.Unlock()
+
+		if err := st.peer.writeFrame(&Frame{Type: FrameData, StreamID: st.id, Payload: b[written : written+n]}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return written, nil
+}
+
+func (st *Stream) writeErr() error {
+	switch {
+	case st.localClosed, st.remoteClosed:
+		return ErrStreamClosed
+	default:
+		return st.err
+	}
+}
+
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.buff.Reset()
+	done := st.remoteClosed || st.err != nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	if done {
+		st.peer.removeStream(st.id)
+		if st.err != nil {
+			return nil
+		}
+	}
+
+	return st.peer.writeFrame(&Frame{Type: FrameClose, StreamID: st.id})
+}
+
+// Reset aborts the stream. Unlike Close, the remote side does not see a
+// clean EOF but ErrStreamReset, and any data it has not read yet is dropped.
+func (st *Stream) Reset() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.buff.Reset()
+	failed := st.err != nil
+	st.cond.Broadcast()
+	st.mu.Unlock()
+
+	st.peer.removeStream(st.id)
+	if failed {
+		return nil
+	}
+
+	return st.peer.writeFrame(&Frame{Type: FrameReset, StreamID: st.id})
+}
+
+func (st *Stream) receive(b []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.localClosed {
+		return nil
+	}
+	if st.buff.Len()+len(b) > streamWindow {
+		return errors.New("stream flow control window exceeded")
+	}
+
+	st.buff.Write(b)
+	st.cond.Broadcast()
+
+	return nil
+}
+
+func (st *Stream) grant(n int) {
+	st.mu.Lock()
+	st.credit += n
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) closeRemote() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.remoteClosed = true
+	st.cond.Broadcast()
+
+	return st.localClosed
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
+
+func (st *Stream) reset() {
+	st.mu.Lock()
+	st.buff.Reset()
+	st.err = ErrStreamReset
+	st.cond.Broadcast()
+	st.mu.Unlock()
+}
@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func servePeer(p *TCPPeer, msgs chan<- []byte) {
+	defer p.closeStreams(io.ErrUnexpectedEOF)
+
+	dec := NewDecoder(p.Conn)
+	for {
+		var f Frame
+		if err := dec.Decode(&f); err != nil {
+			return
+		}
+
+		if f.Type == FrameMessage {
+			msgs <- f.Payload
+			continue
+		}
+
+		if err := p.handleFrame(&f); err != nil {
+			return
+		}
+	}
+}
+
+func newPeerPair(t *testing.T) (*TCPPeer, *TCPPeer, chan []byte, chan []byte) {
+	c1, c2 := net.Pipe()
+	a := NewTCPPeer(c1, false)
+	b := NewTCPPeer(c2, true)
+
+	aMsgs := make(chan []byte, 64)
+	bMsgs := make(chan []byte, 64)
+	go servePeer(a, aMsgs)
+	go servePeer(b, bMsgs)
+
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	return a, b, aMsgs, bMsgs
+}
+
+// openAnnounced opens a stream on from and tells the remote side its ID with
+// a message frame, mirroring how the file server pairs messages and streams.
+func openAnnounced(t *testing.T, from, to *TCPPeer, toMsgs <-chan []byte) (*Stream, *Stream) {
+	st, err := from.OpenStream()
+	assert.Nil(t, err)
+
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, st.ID())
+	assert.Nil(t, from.Send(id))
+
+	remote, err := to.AcceptStream(binary.BigEndian.Uint32(<-toMsgs))
+	assert.Nil(t, err)
+
+	return st, remote
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	a, b, _, bMsgs := newPeerPair(t)
+	local, remote := openAnnounced(t, a, b, bMsgs)
+
+	data := make([]byte, 4*streamWindow+123)
+	rand.Read(data)
+
+	go func() {
+		local.Write(data)
+		local.Close()
+	}()
+
+	got, err := io.ReadAll(remote)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+	assert.Nil(t, remote.Close())
+}
+
+func TestConcurrentStreams(t *testing.T) {
+	a, b, aMsgs, bMsgs := newPeerPair(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		from, to, toMsgs := a, b, bMsgs
+		if i%2 == 1 {
+			from, to, toMsgs = b, a, aMsgs
+		}
+		local, remote := openAnnounced(t, from, to, toMsgs)
+
+		data := bytes.Repeat([]byte{byte(i)}, streamWindow+i*1000)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := local.Write(data)
+			assert.Nil(t, err)
+			local.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			got, err := io.ReadAll(remote)
+			assert.Nil(t, err)
+			assert.Equal(t, data, got)
+			remote.Close()
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestStreamCloseUnblocksWriter(t *testing.T) {
+	a, b, _, bMsgs := newPeerPair(t)
+	local, remote := openAnnounced(t, a, b, bMsgs)
+
+	errChan := make(chan error)
+	go func() {
+		_, err := local.Write(make([]byte, 2*streamWindow))
+		errChan <- err
+	}()
+
+	assert.Nil(t, remote.Close())
+	assert.ErrorIs(t, <-errChan, ErrStreamClosed)
+}
+
+func TestStreamReset(t *testing.T) {
+	a, b, _, bMsgs := newPeerPair(t)
+	local, remote := openAnnounced(t, a, b, bMsgs)
+
+	_, err := local.Write([]byte("partial"))
+	assert.Nil(t, err)
+	assert.Nil(t, local.Reset())
+
+	_, err = io.ReadAll(remote)
+	assert.ErrorIs(t, err, ErrStreamReset)
+	assert.Nil(t, remote.Close())
+}
+
+func TestUnacceptedStreamIsReset(t *testing.T) {
+	defer func(d time.Duration) { streamAcceptTimeout = d }(streamAcceptTimeout)
+	streamAcceptTimeout = 50 * time.Millisecond
+
+	a, b, _, _ := newPeerPair(t)
+	st, err := a.OpenStream()
+	assert.Nil(t, err)
+
+	_, err = io.ReadAll(st)
+	assert.ErrorIs(t, err, ErrStreamReset)
+
+	_, err = b.AcceptStream(st.ID())
+	assert.ErrorIs(t, err, ErrStreamNotFound)
+}
+
+func TestPingDoesNotBlockOnWrites(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// Nothing reads c2, so writing a pong to it would block.
+	p := NewTCPPeer(c1, false)
+	assert.Nil(t, p.handleFrame(&Frame{Type: FramePing}))
+	assert.Nil(t, p.handleFrame(&Frame{Type: FramePing}))
+	assert.Len(t, p.pong, 1)
+}
@@ -1,37 +1,226 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
+)
+
+const (
+	dialTimeout = time.Second * 5
+
+	DefaultHeartbeatInterval = time.Second * 5
+	DefaultHeartbeatTimeout  = time.Second * 15
 )
 
 type TCPPeer struct {
 	net.Conn
+	id       string
+	localID  string
 	incoming bool
-	wg       sync.WaitGroup
+	sendLock sync.Mutex
+	// advertise is the listen address sent to the remote during the
+	// handshake, and listenAddr the one it sent back.
+	advertise  string
+	listenAddr string
+	done       chan struct{}
+	// pong holds a pong owed to the remote until the heartbeat loop sends
+	// it, so answering a ping never blocks reading frames.
+	pong chan struct{}
+
+	streamLock   sync.Mutex
+	streams      map[uint32]*Stream
+	nextStreamID uint32
+	closeErr     error
 }
 
 func NewTCPPeer(conn net.Conn, incoming bool) *TCPPeer {
+	// Streams opened by the dialing side use odd IDs and streams opened by
+	// the accepting side use even IDs, so both ends can open concurrently.
+	nextStreamID := uint32(1)
+	if incoming {
+		nextStreamID = 2
+	}
+
 	return &TCPPeer{
-		Conn:     conn,
-		incoming: incoming,
+		Conn:         conn,
+		incoming:     incoming,
+		done:         make(chan struct{}),
+		pong:         make(chan struct{}, 1),
+		streams:      make(map[uint32]*Stream),
+		nextStreamID: nextStreamID,
 	}
 }
 
+func (p *TCPPeer) ID() string {
+	if p.id == "" {
+		return p.RemoteAddr().String()
+	}
+
+	return p.id
+}
+
+// ListenAddr returns the address the remote node accepts connections on, as
+// it advertised it during the handshake or, failing that, as it was dialed.
+// It is empty for an inbound peer that did not advertise one.
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
+// preferred reports whether the connection was dialed by the node with the
+// lower ID, which is the one both ends keep when they find themselves
+// connected twice.
+func (p *TCPPeer) preferred() bool {
+	return p.localID != "" && p.incoming == (p.id < p.localID)
+}
+
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.writeFrame(&Frame{Type: FrameMessage, Payload: b})
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+func (p *TCPPeer) OpenStream() (*Stream, error) {
+	p.streamLock.Lock()
+	if p.closeErr != nil {
+		p.streamLock.Unlock()
+		return nil, p.closeErr
+	}
+	id := p.nextStreamID
+	p.nextStreamID += 2
+	st := newStream(id, p)
+	p.streams[id] = st
+	p.streamLock.Unlock()
+
+	if err := p.writeFrame(&Frame{Type: FrameOpen, StreamID: id}); err != nil {
+		p.removeStream(id)
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (p *TCPPeer) AcceptStream(id uint32) (*Stream, error) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	st, ok := p.streams[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrStreamNotFound, id)
+	}
+	st.accepted = true
+
+	return st, nil
+}
+
+func (p *TCPPeer) writeFrame(f *Frame) error {
+	p.sendLock.Lock()
+	defer p.sendLock.Unlock()
+
+	return NewEncoder(p.Conn).Encode(f)
+}
+
+func (p *TCPPeer) stream(id uint32) *Stream {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+
+	return p.streams[id]
+}
+
+func (p *TCPPeer) removeStream(id uint32) {
+	p.streamLock.Lock()
+	delete(p.streams, id)
+	p.streamLock.Unlock()
+}
+
+// expireStream resets a stream the remote opened if it still has not been
+// accepted, so streams nobody asked for do not pile up.
+func (p *TCPPeer) expireStream(st *Stream) {
+	p.streamLock.Lock()
+	expired := !st.accepted && p.streams[st.id] == st
+	if expired {
+		delete(p.streams, st.id)
+	}
+	p.streamLock.Unlock()
+
+	if expired {
+		st.Reset()
+	}
+}
+
+func (p *TCPPeer) handleFrame(f *Frame) error {
+	switch f.Type {
+	case FramePing:
+		select {
+		case p.pong <- struct{}{}:
+		default:
+		}
+		return nil
+	case FramePong:
+		return nil
+	}
+
+	if f.Type == FrameOpen {
+		p.streamLock.Lock()
+		defer p.streamLock.Unlock()
+
+		if _, ok := p.streams[f.StreamID]; ok {
+			return fmt.Errorf("stream %d opened twice", f.StreamID)
+		}
+		st := newStream(f.StreamID, p)
+		p.streams[f.StreamID] = st
+		time.AfterFunc(streamAcceptTimeout, func() { p.expireStream(st) })
+		return nil
+	}
+
+	// Frames for streams that were already torn down locally are dropped.
+	st := p.stream(f.StreamID)
+	if st == nil {
+		return nil
+	}
+
+	switch f.Type {
+	case FrameData:
+		return st.receive(f.Payload)
+	case FrameWindow:
+		if len(f.Payload) != 4 {
+			return fmt.Errorf("invalid window update for stream %d", f.StreamID)
+		}
+		st.grant(int(binary.BigEndian.Uint32(f.Payload)))
+	case FrameClose:
+		if st.closeRemote() {
+			p.removeStream(f.StreamID)
+		}
+	case FrameReset:
+		st.reset()
+	default:
+		return fmt.Errorf("unknown frame type: 0x%x", f.Type)
+	}
+
+	return nil
+}
+
+func (p *TCPPeer) closeStreams(err error) {
+	p.streamLock.Lock()
+	p.closeErr = err
+	streams := p.streams
+	p.streams = make(map[uint32]*Stream)
+	p.streamLock.Unlock()
+
+	for _, st := range streams {
+		st.fail(err)
+	}
 }
 
 type OnPeerFunc func(Peer) error
 
+// OnPeerDisconnectFunc is called once a peer that OnPeer accepted has lost
+// its connection.
+type OnPeerDisconnectFunc func(Peer)
+
 type TCPTransport struct {
 	listenAddr string
 	handshake  HandshakeFunc
@@ -39,15 +228,47 @@ type TCPTransport struct {
 	listener   net.Listener
 	msgChan    chan Message
 	OnPeer     OnPeerFunc
+	// OnPeerDisconnect is called when a connected peer goes away.
+	OnPeerDisconnect OnPeerDisconnectFunc
+	// HeartbeatInterval is how often each peer is pinged, and
+	// HeartbeatTimeout how long a peer may stay silent before its
+	// connection is considered dead and closed.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// NodeID is the ID the default handshake presents this node by.
+	// Defaults to the listen address. Authenticating handshakes present the
+	// node identity's ID instead.
+	NodeID string
+	// AdvertiseAddr is the address peers are told to dial this node on.
+	// Defaults to the listen address. Peers fill in a missing or
+	// unspecified host with the one they see the connection come from.
+	AdvertiseAddr string
+	// Backoff spaces out the redials of peers kept connected by Connect.
+	Backoff   Backoff
+	connLock  sync.Mutex
+	conns     map[net.Conn]struct{}
+	peers     map[string]*TCPPeer
+	desired   map[string]struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPTransport(addr string, handshake HandshakeFunc, decode DecodeFunc, onPeer OnPeerFunc) *TCPTransport {
 	return &TCPTransport{
-		listenAddr: addr,
-		handshake:  handshake,
-		decode:     decode,
-		OnPeer:     onPeer,
-		msgChan:    make(chan Message),
+		listenAddr:        addr,
+		handshake:         handshake,
+		decode:            decode,
+		OnPeer:            onPeer,
+		msgChan:           make(chan Message),
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		HeartbeatTimeout:  DefaultHeartbeatTimeout,
+		NodeID:            addr,
+		AdvertiseAddr:     addr,
+		Backoff:           DefaultBackoff,
+		conns:             make(map[net.Conn]struct{}),
+		peers:             make(map[string]*TCPPeer),
+		desired:           make(map[string]struct{}),
+		closeChan:         make(chan struct{}),
 	}
 }
 
@@ -59,21 +280,136 @@ func (t *TCPTransport) Consume() <-chan Message {
 	return t.msgChan
 }
 
+// Close stops accepting connections and closes every open one.
 func (t *TCPTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.closeChan) })
+
+	t.connLock.Lock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.connLock.Unlock()
+
+	if t.listener == nil {
+		return nil
+	}
+
 	return t.listener.Close()
 }
 
+func (t *TCPTransport) track(conn net.Conn) bool {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	select {
+	case <-t.closeChan:
+		return false
+	default:
+	}
+
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *TCPTransport) untrack(conn net.Conn) {
+	t.connLock.Lock()
+	delete(t.conns, conn)
+	t.connLock.Unlock()
+}
+
+// register records peer as the connection to its node. When the two nodes
+// are already connected, both ends keep the connection dialed by the node
+// with the lower ID, or the newer one if both were dialed the same way. It
+// reports whether peer was kept, and returns the connection that lost.
+func (t *TCPTransport) register(peer *TCPPeer) (*TCPPeer, bool) {
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	old, ok := t.peers[peer.ID()]
+	if ok && old.preferred() && !peer.preferred() {
+		return old, false
+	}
+	t.peers[peer.ID()] = peer
+
+	return old, true
+}
+
+func (t *TCPTransport) unregister(peer *TCPPeer) {
+	t.connLock.Lock()
+	if t.peers[peer.ID()] == peer {
+		delete(t.peers, peer.ID())
+	}
+	t.connLock.Unlock()
+}
+
 func (t *TCPTransport) Dial(addr string) error {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	go t.handleConn(conn, false)
+	go t.handleConn(conn, false, addr)
 
 	return nil
 }
 
+// Connect keeps a connection to addr open until the transport is closed,
+// redialing with backoff while addr cannot be reached and whenever the
+// connection drops. Connecting to an address twice has no effect.
+func (t *TCPTransport) Connect(addr string) {
+	t.connLock.Lock()
+	_, ok := t.desired[addr]
+	t.desired[addr] = struct{}{}
+	t.connLock.Unlock()
+
+	if !ok {
+		go t.maintain(addr)
+	}
+}
+
+func (t *TCPTransport) maintain(addr string) {
+	failures := 0
+	for {
+		var peer *TCPPeer
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err == nil {
+			peer = t.handleConn(conn, false, addr)
+		}
+
+		if peer != nil {
+			// A duplicate of an existing connection is not redialed
+			// until that one is gone.
+			select {
+			case <-peer.done:
+			case <-t.closeChan:
+				return
+			}
+			failures = 0
+		} else {
+			failures++
+		}
+
+		select {
+		case <-t.closeChan:
+			return
+		default:
+		}
+
+		delay := t.Backoff.Delay(failures)
+		if err != nil {
+			log.Printf("dial %s failed, retrying in %s: %v", addr, delay.Round(time.Millisecond), err)
+		} else {
+			log.Printf("connection to %s closed, redialing in %s", addr, delay.Round(time.Millisecond))
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-t.closeChan:
+			return
+		}
+	}
+}
+
 func (t *TCPTransport) ListenAndAccept() error {
 	ln, err := net.Listen("tcp", t.listenAddr)
 	if err != nil {
@@ -100,44 +436,106 @@ func (t *TCPTransport) acceptLoop() {
 			continue
 		}
 
-		go t.handleConn(conn, true)
+		go t.handleConn(conn, true, "")
 	}
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, incoming bool) {
+// handleConn serves conn, dialed at addr if it is outgoing, until it fails.
+// It returns the peer the connection was established with, or the existing
+// connection to the same node if this one turned out to duplicate it, and
+// nil if no peer was established.
+func (t *TCPTransport) handleConn(conn net.Conn, incoming bool, addr string) *TCPPeer {
 	defer conn.Close()
 
+	if !t.track(conn) {
+		return nil
+	}
+	defer t.untrack(conn)
+
 	peer := NewTCPPeer(conn, incoming)
+	peer.localID = t.NodeID
+	peer.advertise = t.AdvertiseAddr
+	peer.listenAddr = addr
+	defer close(peer.done)
+	defer peer.closeStreams(io.ErrUnexpectedEOF)
 
 	if err := t.handshake(peer); err != nil {
 		fmt.Println("handshake failed:", err)
-		return
+		return nil
+	}
+
+	other, kept := t.register(peer)
+	if !kept {
+		log.Printf("dropping duplicate connection to %s", peer.ID())
+		return other
+	}
+	defer t.unregister(peer)
+	if other != nil {
+		log.Printf("replacing duplicate connection to %s", peer.ID())
+		other.Close()
 	}
 
 	if t.OnPeer != nil {
 		if err := t.OnPeer(peer); err != nil {
 			fmt.Println("on peer function failed:", err)
-			return
+			return nil
 		}
 	}
+	defer func() {
+		conn.Close()
+		if t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
+	}()
+
+	go t.heartbeat(peer)
 
 	for {
-		msg := Message{}
-		if err := t.decode(conn, &msg); err != nil {
+		// Any frame, pongs included, shows the peer is alive. One that
+		// stays silent past the timeout is on a half-open connection.
+		peer.Conn.SetReadDeadline(time.Now().Add(t.HeartbeatTimeout))
+
+		f := Frame{}
+		if err := t.decode(peer.Conn, &f); err != nil {
 			fmt.Println("error decoding message:", err)
-			return
+			return peer
 		}
 
-		msg.From = conn.RemoteAddr().String()
-
-		if msg.Stream {
-			peer.wg.Add(1)
-			log.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			log.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
+		if f.Type != FrameMessage {
+			if err := peer.handleFrame(&f); err != nil {
+				fmt.Println("error handling frame:", err)
+				return peer
+			}
 			continue
 		}
 
-		t.msgChan <- msg
+		select {
+		case t.msgChan <- Message{From: peer.ID(), Payload: f.Payload}:
+		case <-t.closeChan:
+			return peer
+		}
+	}
+}
+
+// heartbeat pings peer every HeartbeatInterval until its connection is
+// done, so the remote end hears from it even when there is nothing else to
+// send. It also answers the pings the peer sends.
+func (t *TCPTransport) heartbeat(peer *TCPPeer) {
+	ticker := time.NewTicker(t.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := peer.writeFrame(&Frame{Type: FramePing}); err != nil {
+				return
+			}
+		case <-peer.pong:
+			if err := peer.writeFrame(&Frame{Type: FramePong}); err != nil {
+				return
+			}
+		case <-peer.done:
+			return
+		}
 	}
 }
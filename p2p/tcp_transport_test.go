@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -13,3 +15,148 @@ func TestTCPTransport(t *testing.T) {
 
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+func TestBackoffDelay(t *testing.T) {
+	b := Backoff{Min: 100 * time.Millisecond, Max: time.Second}
+	assert.Equal(t, 100*time.Millisecond, b.Delay(0))
+	assert.Equal(t, 400*time.Millisecond, b.Delay(2))
+	assert.Equal(t, time.Second, b.Delay(10))
+
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := b.Delay(1)
+		assert.GreaterOrEqual(t, d, 100*time.Millisecond)
+		assert.LessOrEqual(t, d, 300*time.Millisecond)
+	}
+}
+
+func TestConnectRedials(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	peers := make(chan Peer, 1)
+	tr := NewTCPTransport("127.0.0.1:0", DefaultHandshakeFunc, DefaultDecodeFunc, func(p Peer) error {
+		peers <- p
+		return nil
+	})
+	tr.Backoff = Backoff{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	defer tr.Close()
+
+	// The remote is not up yet, so the first dials fail.
+	tr.Connect(addr)
+	tr.Connect(addr)
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		remote := NewTCPTransport(addr, DefaultHandshakeFunc, DefaultDecodeFunc, nil)
+		assert.Nil(t, remote.ListenAndAccept())
+
+		select {
+		case <-peers:
+		case <-time.After(5 * time.Second):
+			t.Fatal("transport did not connect")
+		}
+		select {
+		case <-peers:
+			t.Fatal("transport connected twice to one address")
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		// Dropping the connection makes the transport redial.
+		remote.Close()
+	}
+}
+
+func TestHeartbeatDetectsSilentPeer(t *testing.T) {
+	disconnected := make(chan Peer, 2)
+	newTransport := func() *TCPTransport {
+		tr := NewTCPTransport("127.0.0.1:0", DefaultHandshakeFunc, DefaultDecodeFunc, nil)
+		tr.HeartbeatInterval = 20 * time.Millisecond
+		tr.HeartbeatTimeout = 100 * time.Millisecond
+		tr.OnPeerDisconnect = func(p Peer) { disconnected <- p }
+		return tr
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	ln.Close()
+
+	server := newTransport()
+	server.listenAddr = addr
+	server.NodeID = addr
+	assert.Nil(t, server.ListenAndAccept())
+	defer server.Close()
+
+	// Peers that ping each other stay connected.
+	client := newTransport()
+	assert.Nil(t, client.Dial(addr))
+	select {
+	case <-disconnected:
+		t.Fatal("heartbeating peer was disconnected")
+	case <-time.After(300 * time.Millisecond):
+	}
+	client.Close()
+	for i := 0; i < 2; i++ {
+		<-disconnected
+	}
+
+	// A peer that stops talking after the handshake, as on a half-open
+	// connection, is dropped.
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Nil(t, DefaultHandshakeFunc(NewTCPPeer(conn, false)))
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent peer was not disconnected")
+	}
+}
+
+func TestDuplicateConnectionsAreDropped(t *testing.T) {
+	newTransport := func() *TCPTransport {
+		id, err := NewIdentity()
+		assert.Nil(t, err)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+		addr := ln.Addr().String()
+		ln.Close()
+
+		tr := NewTCPTransport(addr, NewAuthHandshakeFunc(id, nil), DefaultDecodeFunc, nil)
+		assert.Nil(t, tr.ListenAndAccept())
+		t.Cleanup(func() { tr.Close() })
+
+		return tr
+	}
+	peerOf := func(tr *TCPTransport) (*TCPPeer, int) {
+		tr.connLock.Lock()
+		defer tr.connLock.Unlock()
+
+		for _, p := range tr.peers {
+			return p, len(tr.conns)
+		}
+		return nil, len(tr.conns)
+	}
+
+	a, b := newTransport(), newTransport()
+
+	// Both ends dial at once, and keep the same single connection.
+	assert.Nil(t, a.Dial(b.Addr()))
+	assert.Nil(t, b.Dial(a.Addr()))
+
+	assert.Eventually(t, func() bool {
+		pa, na := peerOf(a)
+		pb, nb := peerOf(b)
+		return pa != nil && pb != nil && na == 1 && nb == 1 &&
+			pa.LocalAddr().String() == pb.RemoteAddr().String()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pa, _ := peerOf(a)
+	pb, _ := peerOf(b)
+	assert.Equal(t, b.Addr(), pa.ListenAddr())
+	assert.Equal(t, a.Addr(), pb.ListenAddr())
+}
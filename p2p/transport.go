@@ -4,13 +4,20 @@ import "net"
 
 type Peer interface {
 	net.Conn
+	ID() string
+	// ListenAddr is the address the remote node accepts connections on.
+	ListenAddr() string
 	Send([]byte) error
-	CloseStream()
+	OpenStream() (*Stream, error)
+	AcceptStream(uint32) (*Stream, error)
 }
 
 type Transport interface {
 	Addr() string
 	Dial(string) error
+	// Connect keeps the transport connected to an address, redialing it
+	// whenever the connection is lost.
+	Connect(string)
 	ListenAndAccept() error
 	Consume() <-chan Message
 	Close() error
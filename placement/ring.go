@@ -0,0 +1,121 @@
+package placement
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const DefaultVirtualNodes = 64
+
+// Ring is a consistent hash ring. Each node is placed at several virtual
+// points so keys spread evenly and only about 1/n of them move when a node
+// joins or leaves.
+type Ring struct {
+	mu     sync.RWMutex
+	vnodes int
+	points []uint64
+	owners map[uint64]string
+	nodes  map[string]bool
+}
+
+func NewRing(vnodes int) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	return &Ring{
+		vnodes: vnodes,
+		owners: make(map[uint64]string),
+		nodes:  make(map[string]bool),
+	}
+}
+
+func hashPoint(s string) uint64 {
+	digest := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(digest[:8])
+}
+
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+
+	for i := 0; i < r.vnodes; i++ {
+		point := hashPoint(fmt.Sprintf("%s#%d", node, i))
+		if _, taken := r.owners[point]; taken {
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
+
+// Owners returns up to n distinct nodes responsible for key, in preference
+// order, found by walking the ring clockwise from the key's point.
+func (r *Ring) Owners(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return nil
+	}
+
+	point := hashPoint(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+
+	owners := make([]string, 0, n)
+	seen := make(map[string]bool, n)
+	for i := 0; len(owners) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		owners = append(owners, node)
+	}
+
+	return owners
+}
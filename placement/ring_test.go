@@ -0,0 +1,72 @@
+package placement
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingOwners(t *testing.T) {
+	r := NewRing(DefaultVirtualNodes)
+	assert.Empty(t, r.Owners("key", 3))
+
+	for i := 0; i < 5; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	owners := r.Owners("key", 3)
+	assert.Len(t, owners, 3)
+	assert.NotEqual(t, owners[0], owners[1])
+	assert.NotEqual(t, owners[1], owners[2])
+	assert.NotEqual(t, owners[0], owners[2])
+	assert.Equal(t, owners, r.Owners("key", 3))
+
+	assert.Len(t, r.Owners("key", 10), 5)
+}
+
+func TestRingBalance(t *testing.T) {
+	r := NewRing(DefaultVirtualNodes)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		counts[r.Owners(fmt.Sprintf("key-%d", i), 1)[0]]++
+	}
+
+	for node, count := range counts {
+		assert.InDelta(t, 2500, count, 1000, "node %s", node)
+	}
+}
+
+func TestRingMinimalMovement(t *testing.T) {
+	r := NewRing(DefaultVirtualNodes)
+	for i := 0; i < 4; i++ {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	before := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before[key] = r.Owners(key, 1)[0]
+	}
+
+	r.Add("node-4")
+
+	moved := 0
+	for key, owner := range before {
+		now := r.Owners(key, 1)[0]
+		if now != owner {
+			assert.Equal(t, "node-4", now)
+			moved++
+		}
+	}
+	assert.InDelta(t, 2000, moved, 1000)
+
+	r.Remove("node-4")
+	for key, owner := range before {
+		assert.Equal(t, owner, r.Owners(key, 1)[0])
+	}
+}
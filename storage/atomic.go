@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempMarker is part of the name of every temp file storage writes, so
+// ones orphaned by a crash can be told apart from blobs and cleaned up.
+const tempMarker = ".tmp-"
+
+// writeAtomic writes r to path through an fsynced temp file in the same
+// directory which is then renamed into place, and fsyncs the directory so
+// the rename itself survives a crash. Readers see either the previous
+// contents of path or all of the new ones, never a partial write.
+func writeAtomic(path string, r io.Reader) (int64, error) {
+	dir, name := filepath.Split(path)
+
+	f, err := os.CreateTemp(dir, name+tempMarker+"*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return n, syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+func isTemp(name string) bool {
+	return strings.Contains(name, tempMarker)
+}
+
+// Recover removes temp files left behind by writes that were interrupted by
+// a crash, returning how many it removed. It must run before the storage is
+// written to, as it cannot tell an orphan from a write in progress.
+func (s *Storage) Recover() (int, error) {
+	removed := 0
+
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTemp(d.Name()) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+
+	return removed, err
+}
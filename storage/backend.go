@@ -0,0 +1,22 @@
+package storage
+
+import "io"
+
+// Backend stores blobs under arbitrary string keys. Reading, statting or
+// deleting a missing key returns an error wrapping fs.ErrNotExist, except
+// that deleting one is not an error.
+type Backend interface {
+	Read(key string) (int64, io.ReadCloser, error)
+	Write(key string, r io.Reader) (int64, error)
+	Exists(key string) bool
+	Delete(key string) error
+	// List returns the keys starting with prefix, sorted by key.
+	List(prefix string) ([]KeyInfo, error)
+	Stat(key string) (KeyInfo, error)
+}
+
+var (
+	_ Backend = (*Storage)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+	_ Backend = (*PackBackend)(nil)
+)
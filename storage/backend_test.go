@@ -0,0 +1,224 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackends(t *testing.T) map[string]Backend {
+	pack, err := OpenPack(filepath.Join(t.TempDir(), "store.pack"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { pack.Close() })
+
+	return map[string]Backend{
+		"disk":   NewStorage(t.TempDir(), DefaultPathTransformFunc),
+		"memory": NewMemoryBackend(),
+		"pack":   pack,
+	}
+}
+
+func readAll(t *testing.T, b Backend, key string) []byte {
+	n, r, err := b.Read(key)
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), n)
+
+	return data
+}
+
+func TestBackends(t *testing.T) {
+	for name, b := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"logs/a", "logs/b", "photos/c"} {
+				n, err := b.Write(key, bytes.NewReader([]byte(key)))
+				assert.Nil(t, err)
+				assert.Equal(t, int64(len(key)), n)
+			}
+
+			assert.True(t, b.Exists("logs/a"))
+			assert.Equal(t, []byte("logs/a"), readAll(t, b, "logs/a"))
+
+			before, err := b.Stat("logs/a")
+			assert.Nil(t, err)
+			_, err = b.Write("logs/a", bytes.NewReader([]byte("overwritten")))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("overwritten"), readAll(t, b, "logs/a"))
+
+			info, err := b.Stat("logs/a")
+			assert.Nil(t, err)
+			assert.Equal(t, int64(11), info.Size)
+			assert.True(t, info.Created.Equal(before.Created))
+			assert.NotEqual(t, before.Checksum, info.Checksum)
+
+			assert.Nil(t, b.Delete("logs/b"))
+			assert.Nil(t, b.Delete("missing"))
+			assert.False(t, b.Exists("logs/b"))
+
+			_, _, err = b.Read("logs/b")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			_, err = b.Stat("logs/b")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			infos, err := b.List("logs/")
+			assert.Nil(t, err)
+			if assert.Len(t, infos, 1) {
+				assert.Equal(t, "logs/a", infos[0].Key)
+			}
+			infos, err = b.List("")
+			assert.Nil(t, err)
+			assert.Len(t, infos, 2)
+		})
+	}
+}
+
+func TestStoreOnBackends(t *testing.T) {
+	for name, b := range testBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			s := NewStore(b)
+
+			_, err := s.WriteChunk("aa01", bytes.NewReader([]byte("chunk")))
+			assert.Nil(t, err)
+			m := &Manifest{Key: "file", Size: 5, Chunks: []ChunkRef{{Hash: "aa01", Size: 5}}}
+			assert.Nil(t, s.WriteManifest("file", m))
+
+			files, err := s.List("")
+			assert.Nil(t, err)
+			if assert.Len(t, files, 1) {
+				assert.Equal(t, "file", files[0].Key)
+				assert.Equal(t, int64(5), files[0].Size)
+			}
+
+			chunks, err := s.Chunks()
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"aa01"}, chunks)
+
+			assert.ErrorIs(t, s.WriteManifest(chunkPrefix+"aa01", m), ErrReservedKey)
+
+			assert.Nil(t, s.Quarantine(chunkPrefix+"aa01"))
+			assert.False(t, s.HasChunk("aa01"))
+			quarantined, err := s.Quarantined()
+			assert.Nil(t, err)
+			if assert.Len(t, quarantined, 1) {
+				assert.Equal(t, chunkPrefix+"aa01", quarantined[0].Key)
+			}
+			blobs, err := s.Blobs()
+			assert.Nil(t, err)
+			if assert.Len(t, blobs, 1) {
+				assert.Equal(t, "file", blobs[0].Key)
+			}
+		})
+	}
+}
+
+func TestPackPersistsAcrossReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+
+	b, err := OpenPack(path)
+	assert.Nil(t, err)
+	_, err = b.Write("kept", bytes.NewReader([]byte("kept data")))
+	assert.Nil(t, err)
+	_, err = b.Write("deleted", bytes.NewReader([]byte("deleted data")))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Delete("deleted"))
+	assert.Nil(t, b.Close())
+
+	b, err = OpenPack(path)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	assert.Equal(t, []byte("kept data"), readAll(t, b, "kept"))
+	assert.False(t, b.Exists("deleted"))
+}
+
+func TestPackDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+
+	b, err := OpenPack(path)
+	assert.Nil(t, err)
+	_, err = b.Write("first", bytes.NewReader([]byte("first data")))
+	assert.Nil(t, err)
+	_, err = b.Write("second", bytes.NewReader([]byte("second data")))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	// Lose the last byte of the second record, as a crash could.
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Truncate(path, stat.Size()-1))
+
+	b, err = OpenPack(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("first data"), readAll(t, b, "first"))
+	assert.False(t, b.Exists("second"))
+
+	_, err = b.Write("third", bytes.NewReader([]byte("third data")))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	b, err = OpenPack(path)
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Equal(t, []byte("third data"), readAll(t, b, "third"))
+}
+
+func TestPackRejectsCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+
+	b, err := OpenPack(path)
+	assert.Nil(t, err)
+	_, err = b.Write("first", bytes.NewReader([]byte("first data")))
+	assert.Nil(t, err)
+	_, err = b.Write("second", bytes.NewReader([]byte("second data")))
+	assert.Nil(t, err)
+	assert.Nil(t, b.Close())
+
+	// Flip a bit in the data of the first record.
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	i := bytes.Index(data, []byte("first data"))
+	data[i] ^= 1
+	assert.Nil(t, os.WriteFile(path, data, 0600))
+
+	_, err = OpenPack(path)
+	assert.ErrorIs(t, err, ErrPackCorrupt)
+
+	after, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, data, after)
+}
+
+func TestPackCompactsOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.pack")
+
+	b, err := OpenPack(path)
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("x"), 64<<10)
+	for i := 0; i < 40; i++ {
+		_, err := b.Write("key", bytes.NewReader(data))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, b.Close())
+
+	before, err := os.Stat(path)
+	assert.Nil(t, err)
+
+	b, err = OpenPack(path)
+	assert.Nil(t, err)
+	defer b.Close()
+
+	after, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Less(t, after.Size(), before.Size()/10)
+	assert.Equal(t, data, readAll(t, b, "key"))
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"io"
+)
+
+const (
+	MinChunkSize = 16 << 10
+	AvgChunkSize = 64 << 10
+	MaxChunkSize = 256 << 10
+)
+
+// Normalized chunking masks from FastCDC: a stricter mask before the average
+// chunk size and a looser one after it pull chunk sizes towards the average.
+// The mask bits sit at the top of the fingerprint, which depends on the last
+// 64 bytes read.
+const (
+	maskSmall = uint64(1<<18-1) << (64 - 18)
+	maskLarge = uint64(1<<14-1) << (64 - 14)
+)
+
+var gearTable [256]uint64
+
+func init() {
+	// The table has to be identical on every node for chunk boundaries, and
+	// so deduplication, to line up; derive it from a fixed splitmix64 seed.
+	seed := uint64(0x5ca77e2f5)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks using FastCDC, so an
+// edit to a file only changes the chunks around it.
+type Chunker struct {
+	r     io.Reader
+	buff  []byte
+	start int
+	end   int
+	eof   bool
+}
+
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:    r,
+		buff: make([]byte, 2*MaxChunkSize),
+	}
+}
+
+// Next returns the next chunk, which is only valid until the following call,
+// or io.EOF once the stream is exhausted.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := cutPoint(c.buff[c.start:c.end])
+	chunk := c.buff[c.start : c.start+n]
+	c.start += n
+
+	return chunk, nil
+}
+
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MaxChunkSize {
+		return nil
+	}
+
+	copy(c.buff, c.buff[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+
+	for c.end < len(c.buff) {
+		n, err := c.r.Read(c.buff[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func cutPoint(b []byte) int {
+	if len(b) <= MinChunkSize {
+		return len(b)
+	}
+
+	n := min(len(b), MaxChunkSize)
+	normal := min(n, AvgChunkSize)
+
+	var fp uint64
+	i := MinChunkSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[b[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[b[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func splitChunks(t *testing.T, data []byte) [][]byte {
+	var chunks [][]byte
+
+	c := NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunkerBounds(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+
+	chunks := splitChunks(t, data)
+	assert.Equal(t, data, bytes.Join(chunks, nil))
+
+	for i, chunk := range chunks {
+		assert.LessOrEqual(t, len(chunk), MaxChunkSize)
+		if i < len(chunks)-1 {
+			assert.GreaterOrEqual(t, len(chunk), MinChunkSize)
+		}
+	}
+
+	assert.Empty(t, splitChunks(t, nil))
+}
+
+func TestChunkerIsContentDefined(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.Read(data)
+
+	edited := append(bytes.Clone(data[:1<<20]), []byte("inserted bytes")...)
+	edited = append(edited, data[1<<20:]...)
+
+	original := map[string]bool{}
+	for _, chunk := range splitChunks(t, data) {
+		original[string(chunk)] = true
+	}
+
+	changed := 0
+	for _, chunk := range splitChunks(t, edited) {
+		if !original[string(chunk)] {
+			changed++
+		}
+	}
+
+	assert.LessOrEqual(t, changed, 2)
+}
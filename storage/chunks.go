@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// chunkPrefix namespaces chunk blobs on the backend, apart from file keys.
+	chunkPrefix = ".chunks/"
+	// quarantinePrefix holds blobs found corrupt, kept for inspection
+	// rather than deleted.
+	quarantinePrefix = ".quarantine/"
+)
+
+var (
+	manifestMagic = []byte("SCFSMNFT")
+
+	ErrNotManifest = errors.New("blob is not a manifest")
+	ErrReservedKey = errors.New("key is reserved for internal storage")
+)
+
+type ChunkRef struct {
+	Hash string
+	Size int64
+}
+
+// Manifest lists, in order, the content-addressed chunks that make up a file,
+// along with the file's metadata.
+type Manifest struct {
+	Key string
+	// Version identifies this version of the file. Versioned files keep
+	// their earlier versions archived.
+	Version   string
+	Versioned bool
+	// Deleted marks a tombstone, recording that the file was deleted at
+	// Modified.
+	Deleted     bool
+	Size        int64
+	SHA256      string
+	Created     time.Time
+	Modified    time.Time
+	Owner       string
+	ContentType string
+	Attributes  map[string]string
+	Chunks      []ChunkRef
+	// Clock is the version vector of the write that produced this version.
+	Clock VersionVector
+	// Siblings are versions written concurrently with this one and kept
+	// alongside it until a later write resolves the conflict.
+	Siblings []*Manifest
+}
+
+// Metadata describes a file's plaintext contents and where it came from.
+type Metadata struct {
+	Key     string
+	Version string
+	Deleted bool
+	Size    int64
+	// SHA256 is the hex digest of the plaintext.
+	SHA256   string
+	Created  time.Time
+	Modified time.Time
+	// Owner is the ID of the node the file was stored through.
+	Owner       string
+	ContentType string
+	Attributes  map[string]string
+	Clock       VersionVector
+}
+
+func (m *Manifest) Metadata() Metadata {
+	return Metadata{
+		Key:         m.Key,
+		Version:     m.Version,
+		Deleted:     m.Deleted,
+		Size:        m.Size,
+		SHA256:      m.SHA256,
+		Created:     m.Created,
+		Modified:    m.Modified,
+		Owner:       m.Owner,
+		ContentType: m.ContentType,
+		Attributes:  maps.Clone(m.Attributes),
+		Clock:       maps.Clone(m.Clock),
+	}
+}
+
+// Heads returns the concurrent versions m holds: m itself, without its
+// siblings, followed by each sibling.
+func (m *Manifest) Heads() []*Manifest {
+	head := *m
+	head.Siblings = nil
+
+	return append([]*Manifest{&head}, m.Siblings...)
+}
+
+// MergedClock returns a version vector that has seen every head of m.
+func (m *Manifest) MergedClock() VersionVector {
+	clock := m.Clock.Merge(nil)
+	for _, sibling := range m.Siblings {
+		clock = clock.Merge(sibling.Clock)
+	}
+
+	return clock
+}
+
+// AllChunks returns the chunks of every head of m.
+func (m *Manifest) AllChunks() []ChunkRef {
+	chunks := slices.Clone(m.Chunks)
+	for _, sibling := range m.Siblings {
+		chunks = append(chunks, sibling.Chunks...)
+	}
+
+	return chunks
+}
+
+// Validate checks that every chunk m lists has a size the chunker could have
+// produced. Manifests received from peers are validated before use, as
+// readers allocate a chunk's size up front.
+func (m *Manifest) Validate() error {
+	for _, c := range m.AllChunks() {
+		if c.Size <= 0 || c.Size > MaxChunkSize {
+			return fmt.Errorf("manifest of %s: chunk %s has invalid size %d", m.Key, c.Hash, c.Size)
+		}
+	}
+
+	return nil
+}
+
+// Hashes returns the hashes of the chunks of every head of m.
+func (m *Manifest) Hashes() []string {
+	chunks := m.AllChunks()
+	hashes := make([]string, len(chunks))
+	for i, c := range chunks {
+		hashes[i] = c.Hash
+	}
+	return hashes
+}
+
+// Digest identifies the file content a manifest describes, siblings
+// included, so replicas can compare manifests without exchanging them in
+// full.
+func (m *Manifest) Digest() string {
+	h := sha256.New()
+	if m.Deleted {
+		fmt.Fprint(h, "deleted\n")
+	}
+	fmt.Fprintf(h, "%d\n", m.Size)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(h, "%s %d\n", c.Hash, c.Size)
+	}
+	for _, sibling := range m.Siblings {
+		fmt.Fprintf(h, "sibling %s\n", sibling.Digest())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Store keeps files on a Backend: each file is a manifest stored under its
+// key, listing content-addressed chunks that files share.
+type Store struct {
+	backend Backend
+}
+
+func NewStore(backend Backend) *Store {
+	return &Store{backend: backend}
+}
+
+func (s *Store) Backend() Backend {
+	return s.backend
+}
+
+// ValidateKey rejects keys that would collide with chunk storage, archived
+// versions or the quarantine.
+func ValidateKey(key string) error {
+	for _, prefix := range []string{chunkPrefix, versionPrefix, quarantinePrefix} {
+		if strings.HasPrefix(key, prefix) {
+			return fmt.Errorf("%q: %w", key, ErrReservedKey)
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) Exists(key string) bool {
+	return ValidateKey(key) == nil && s.backend.Exists(key)
+}
+
+func (s *Store) Delete(key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	return s.backend.Delete(key)
+}
+
+// Stat returns key's backend entry, with Size set to the size of the file
+// its manifest describes rather than of the manifest itself. A deleted file
+// does not exist, even while its tombstone is kept.
+func (s *Store) Stat(key string) (KeyInfo, error) {
+	if err := ValidateKey(key); err != nil {
+		return KeyInfo{}, err
+	}
+
+	info, err := s.backend.Stat(key)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	info, ok := s.fileInfo(info)
+	if !ok {
+		return KeyInfo{}, fmt.Errorf("stat %s: %w", key, fs.ErrNotExist)
+	}
+
+	return info, nil
+}
+
+// List returns the files whose keys start with prefix, sorted by key, sized
+// like Stat. Deleted files are left out.
+func (s *Store) List(prefix string) ([]KeyInfo, error) {
+	infos, err := s.backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []KeyInfo{}
+	for _, info := range infos {
+		if ValidateKey(info.Key) != nil {
+			continue
+		}
+		if info, ok := s.fileInfo(info); ok {
+			files = append(files, info)
+		}
+	}
+
+	return files, nil
+}
+
+// fileInfo sizes info from its manifest, reporting false if it is a
+// tombstone.
+func (s *Store) fileInfo(info KeyInfo) (KeyInfo, bool) {
+	m, err := s.ReadManifest(info.Key)
+	if err != nil {
+		return info, true
+	}
+	info.Size = m.Size
+
+	return info, !m.Deleted
+}
+
+// Recover runs the backend's crash recovery, if it has one, returning how
+// many leftovers of interrupted writes it cleaned up.
+func (s *Store) Recover() (int, error) {
+	r, ok := s.backend.(interface{ Recover() (int, error) })
+	if !ok {
+		return 0, nil
+	}
+
+	return r.Recover()
+}
+
+// WriteManifest stores m as the current version of key, archiving each of
+// its heads as well if the file is versioned.
+func (s *Store) WriteManifest(key string, m *Manifest) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	for _, head := range m.Heads() {
+		if !head.Versioned {
+			continue
+		}
+		if err := s.WriteVersion(key, head); err != nil {
+			return err
+		}
+	}
+
+	return s.writeManifest(key, m)
+}
+
+func (s *Store) writeManifest(key string, m *Manifest) error {
+	buff := bytes.NewBuffer(bytes.Clone(manifestMagic))
+	if err := gob.NewEncoder(buff).Encode(m); err != nil {
+		return err
+	}
+
+	_, err := s.backend.Write(key, buff)
+	return err
+}
+
+func (s *Store) ReadManifest(key string) (*Manifest, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, err
+	}
+
+	return s.readManifest(key)
+}
+
+func (s *Store) readManifest(key string) (*Manifest, error) {
+	_, r, err := s.backend.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return DecodeManifest(r)
+}
+
+// DecodeManifest decodes a manifest blob, failing with ErrNotManifest if r
+// holds something else.
+func DecodeManifest(r io.Reader) (*Manifest, error) {
+	magic := make([]byte, len(manifestMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, manifestMagic) {
+		return nil, ErrNotManifest
+	}
+
+	m := &Manifest{}
+	if err := gob.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func chunkKey(hash string) (string, error) {
+	if len(hash) < 2 || strings.ContainsAny(hash, "/\\.") {
+		return "", fmt.Errorf("invalid chunk hash %q", hash)
+	}
+
+	return chunkPrefix + hash, nil
+}
+
+// ChunkHash returns the hash of the chunk stored under the backend key, and
+// false if key does not hold a chunk.
+func ChunkHash(key string) (string, bool) {
+	return strings.CutPrefix(key, chunkPrefix)
+}
+
+func (s *Store) HasChunk(hash string) bool {
+	key, err := chunkKey(hash)
+	if err != nil {
+		return false
+	}
+
+	return s.backend.Exists(key)
+}
+
+// WriteChunk stores a chunk under its hash. Chunks are immutable, so writing
+// one that already exists is a no-op.
+func (s *Store) WriteChunk(hash string, r io.Reader) (int64, error) {
+	key, err := chunkKey(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	if info, err := s.backend.Stat(key); err == nil {
+		return info.Size, nil
+	}
+
+	return s.backend.Write(key, r)
+}
+
+func (s *Store) ReadChunk(hash string) (io.ReadCloser, error) {
+	key, err := chunkKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	_, r, err := s.backend.Read(key)
+	return r, err
+}
+
+func (s *Store) Chunks() ([]string, error) {
+	infos, err := s.backend.List(chunkPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(infos))
+	for i, info := range infos {
+		hashes[i] = strings.TrimPrefix(info.Key, chunkPrefix)
+	}
+
+	return hashes, nil
+}
+
+// Manifests decodes the manifest of every file in the store, tombstones
+// included. Manifests that fail to decode are logged and skipped.
+func (s *Store) Manifests() ([]*Manifest, error) {
+	infos, err := s.backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*Manifest
+	for _, info := range infos {
+		if ValidateKey(info.Key) != nil {
+			continue
+		}
+
+		m, err := s.ReadManifest(info.Key)
+		// Skip files deleted since listing and blobs that are not manifests.
+		if errors.Is(err, ErrNotManifest) || errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		// A damaged manifest is left for the scrubber to repair rather than
+		// failing every caller.
+		if err != nil {
+			log.Printf("skipping manifest %s: %v", info.Key, err)
+			continue
+		}
+
+		manifests = append(manifests, m)
+	}
+
+	return manifests, nil
+}
+
+// Blobs returns every blob on the backend, manifests and chunks alike,
+// sorted by backend key. Quarantined blobs are left out.
+func (s *Store) Blobs() ([]KeyInfo, error) {
+	infos, err := s.backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := []KeyInfo{}
+	for _, info := range infos {
+		if !strings.HasPrefix(info.Key, quarantinePrefix) {
+			blobs = append(blobs, info)
+		}
+	}
+
+	return blobs, nil
+}
+
+// ReadBlob reads the raw blob under a backend key as returned by Blobs.
+func (s *Store) ReadBlob(key string) (io.ReadCloser, error) {
+	_, r, err := s.backend.Read(key)
+	return r, err
+}
+
+// Quarantine moves the blob under a backend key aside, so it is no longer
+// read but its contents remain available for inspection.
+func (s *Store) Quarantine(key string) error {
+	_, r, err := s.backend.Read(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.backend.Write(quarantinePrefix+key, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.backend.Delete(key)
+}
+
+// QuarantineChunk moves a chunk aside the way Quarantine does a blob.
+func (s *Store) QuarantineChunk(hash string) error {
+	key, err := chunkKey(hash)
+	if err != nil {
+		return err
+	}
+
+	return s.Quarantine(key)
+}
+
+// Quarantined lists the quarantined blobs by their original backend keys.
+func (s *Store) Quarantined() ([]KeyInfo, error) {
+	infos, err := s.backend.List(quarantinePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range infos {
+		infos[i].Key = strings.TrimPrefix(infos[i].Key, quarantinePrefix)
+	}
+
+	return infos, nil
+}
+
+// PruneChunks deletes chunks that no manifest, current or archived,
+// references and that were written at least grace ago, returning how many
+// were removed. The grace period covers chunks written ahead of a manifest
+// that is still on its way.
+func (s *Store) PruneChunks(grace time.Duration) (int, error) {
+	manifests, err := s.Manifests()
+	if err != nil {
+		return 0, err
+	}
+	versions, err := s.AllVersions()
+	if err != nil {
+		return 0, err
+	}
+	manifests = append(manifests, versions...)
+
+	live := make(map[string]bool)
+	for _, m := range manifests {
+		for _, c := range m.AllChunks() {
+			live[c.Hash] = true
+		}
+	}
+
+	infos, err := s.backend.List(chunkPrefix)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	cutoff := time.Now().Add(-grace)
+	for _, info := range infos {
+		if live[strings.TrimPrefix(info.Key, chunkPrefix)] || info.Modified.After(cutoff) {
+			continue
+		}
+
+		if err := s.backend.Delete(info.Key); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}
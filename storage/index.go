@@ -0,0 +1,315 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const indexFile = "keys.idx"
+
+// KeyInfo describes a key held in storage. Keys are only stored hashed on
+// disk, so this is the only record of the original key.
+type KeyInfo struct {
+	Key      string
+	Size     int64
+	Created  time.Time
+	Modified time.Time
+	// Checksum is the hex SHA-256 of the stored blob.
+	Checksum string
+}
+
+// indexRecord is one line of the key index log. A record with Deleted set
+// removes the key.
+type indexRecord struct {
+	Deleted bool    `json:",omitempty"`
+	Info    KeyInfo `json:"info"`
+}
+
+func (s *Storage) indexPath() string {
+	return filepath.Join(s.root, indexFile)
+}
+
+// loadIndex reads the key index log into memory. A storage root written
+// before the index existed, or that lost it, is indexed from its manifests
+// instead. The caller must hold indexLock.
+func (s *Storage) loadIndex() error {
+	if s.index != nil {
+		return nil
+	}
+
+	f, err := os.Open(s.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return s.rebuildIndex()
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	index := make(map[string]KeyInfo)
+	records := 0
+	torn := false
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec indexRecord
+		// A crash while appending can leave a torn last line, which is
+		// dropped along with anything after it.
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			torn = true
+			break
+		}
+
+		records++
+		if rec.Deleted {
+			delete(index, rec.Info.Key)
+			continue
+		}
+		index[rec.Info.Key] = rec.Info
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading key index: %w", err)
+	}
+
+	s.index = index
+	s.indexRecords = records
+
+	// Rewrite the log so new records are not appended after the torn one.
+	if torn {
+		return s.compactIndex()
+	}
+
+	return nil
+}
+
+func (s *Storage) rebuildIndex() error {
+	manifests, err := s.scanManifests()
+	if err != nil {
+		return err
+	}
+
+	// Chunk and version blobs are found through the manifests that refer
+	// to them, as their keys cannot be recovered from their own contents.
+	s.index = make(map[string]KeyInfo)
+	for _, m := range manifests {
+		keys := []string{m.Key}
+		if key, err := versionKey(m.Key, m.Version); err == nil {
+			keys = append(keys, key)
+		}
+		for _, c := range m.AllChunks() {
+			keys = append(keys, chunkPrefix+c.Hash)
+		}
+
+		for _, key := range keys {
+			if info, ok := s.statBlob(key); ok {
+				s.index[key] = info
+			}
+		}
+	}
+
+	if len(s.index) == 0 {
+		return nil
+	}
+
+	return s.compactIndex()
+}
+
+// scanManifests decodes every blob under the root that holds a manifest.
+// Other blobs cannot be traced back to their keys.
+func (s *Storage) scanManifests() ([]*Manifest, error) {
+	var manifests []*Manifest
+
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isTemp(d.Name()) {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if m, err := DecodeManifest(f); err == nil && m.Key != "" {
+			manifests = append(manifests, m)
+		}
+		return nil
+	})
+
+	return manifests, err
+}
+
+// statBlob returns an index entry for the blob stored under key, and false
+// if there is none. The blob is read through to record its checksum, so the
+// scrubber can check it from then on.
+func (s *Storage) statBlob(key string) (KeyInfo, bool) {
+	f, err := os.Open(fmt.Sprintf("%s/%s", s.root, s.pathTransformFunc(key).FullPath()))
+	if err != nil {
+		return KeyInfo{}, false
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		return KeyInfo{}, false
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return KeyInfo{}, false
+	}
+
+	return KeyInfo{
+		Key:      key,
+		Size:     stat.Size(),
+		Created:  stat.ModTime(),
+		Modified: stat.ModTime(),
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}, true
+}
+
+// compactIndex rewrites the log with one record per live key. The caller
+// must hold indexLock.
+func (s *Storage) compactIndex() error {
+	if err := os.MkdirAll(s.root, os.ModePerm); err != nil {
+		return err
+	}
+
+	buff := new(bytes.Buffer)
+	enc := json.NewEncoder(buff)
+	for _, info := range s.index {
+		if err := enc.Encode(indexRecord{Info: info}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := writeAtomic(s.indexPath(), buff); err != nil {
+		return err
+	}
+	s.indexRecords = len(s.index)
+
+	return nil
+}
+
+// appendIndex records rec in memory and on disk, compacting the log once
+// it has grown well past the number of live keys.
+func (s *Storage) appendIndex(rec indexRecord) error {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if err := s.loadIndex(); err != nil {
+		return err
+	}
+
+	if rec.Deleted {
+		if _, ok := s.index[rec.Info.Key]; !ok {
+			return nil
+		}
+		delete(s.index, rec.Info.Key)
+	} else {
+		if prev, ok := s.index[rec.Info.Key]; ok {
+			rec.Info.Created = prev.Created
+		}
+		s.index[rec.Info.Key] = rec.Info
+	}
+
+	if s.indexRecords > 2*len(s.index)+1024 {
+		return s.compactIndex()
+	}
+
+	if err := os.MkdirAll(s.root, os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.indexPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := json.NewEncoder(f).Encode(rec); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	s.indexRecords++
+
+	return f.Close()
+}
+
+// Stat returns the index entry for key.
+func (s *Storage) Stat(key string) (KeyInfo, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if err := s.loadIndex(); err != nil {
+		return KeyInfo{}, err
+	}
+
+	info, ok := s.index[key]
+	if !ok {
+		return KeyInfo{}, fmt.Errorf("stat %s: %w", key, os.ErrNotExist)
+	}
+
+	return info, nil
+}
+
+// Walk calls fn for every indexed key in sorted order, stopping at the first
+// error fn returns.
+func (s *Storage) Walk(fn func(KeyInfo) error) error {
+	s.indexLock.Lock()
+	if err := s.loadIndex(); err != nil {
+		s.indexLock.Unlock()
+		return err
+	}
+	infos := make([]KeyInfo, 0, len(s.index))
+	for _, info := range s.index {
+		infos = append(infos, info)
+	}
+	s.indexLock.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns the indexed keys starting with prefix, sorted by key.
+func (s *Storage) List(prefix string) ([]KeyInfo, error) {
+	infos := []KeyInfo{}
+
+	err := s.Walk(func(info KeyInfo) error {
+		if strings.HasPrefix(info.Key, prefix) {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+
+	return infos, err
+}
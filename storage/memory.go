@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryBlob struct {
+	data []byte
+	info KeyInfo
+}
+
+// MemoryBackend keeps blobs in memory. It is meant for tests.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		blobs: make(map[string]memoryBlob),
+	}
+}
+
+func (b *MemoryBackend) Read(key string) (int64, io.ReadCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	blob, ok := b.blobs[key]
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, fs.ErrNotExist)
+	}
+
+	return int64(len(blob.data)), io.NopCloser(bytes.NewReader(blob.data)), nil
+}
+
+func (b *MemoryBackend) Write(key string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	digest := sha256.Sum256(data)
+	now := time.Now()
+	info := KeyInfo{
+		Key:      key,
+		Size:     int64(len(data)),
+		Created:  now,
+		Modified: now,
+		Checksum: hex.EncodeToString(digest[:]),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if prev, ok := b.blobs[key]; ok {
+		info.Created = prev.info.Created
+	}
+	b.blobs[key] = memoryBlob{data: data, info: info}
+
+	return info.Size, nil
+}
+
+func (b *MemoryBackend) Exists(key string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.blobs[key]
+	return ok
+}
+
+func (b *MemoryBackend) Delete(key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.blobs, key)
+	return nil
+}
+
+func (b *MemoryBackend) List(prefix string) ([]KeyInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	infos := []KeyInfo{}
+	for key, blob := range b.blobs {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, blob.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+func (b *MemoryBackend) Stat(key string) (KeyInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	blob, ok := b.blobs[key]
+	if !ok {
+		return KeyInfo{}, fmt.Errorf("stat %s: %w", key, fs.ErrNotExist)
+	}
+
+	return blob.info, nil
+}
@@ -0,0 +1,449 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packVersion = 1
+
+	opPending byte = 0
+	opPut     byte = 'P'
+	opDelete  byte = 'D'
+
+	// op | key length | data length | created | modified | sha256 | crc32
+	packRecordHeaderSize = 1 + 4 + 8 + 8 + 8 + sha256.Size + 4
+
+	// packCompactThreshold is how much dead space a pack must hold, and
+	// outweigh its live data by, before it is compacted on open.
+	packCompactThreshold = 1 << 20
+)
+
+var (
+	packMagic = []byte("SCFSPACK")
+
+	ErrNotPack     = errors.New("file is not a pack")
+	ErrPackCorrupt = errors.New("pack record is corrupt")
+)
+
+type packEntry struct {
+	info    KeyInfo
+	offset  int64
+	dataOff int64
+	end     int64
+}
+
+// PackBackend keeps every blob in a single append-only pack file. Each
+// record is written behind a pending marker and only marked as a put or a
+// delete once its data is synced, and the in-memory index of the latest
+// record per key is rebuilt by scanning the pack on open. Superseded records
+// are reclaimed by compacting the pack when it is reopened.
+type PackBackend struct {
+	path string
+
+	// writeLock serializes appends; mu guards the index and the file size
+	// so reads can proceed while a write streams in.
+	writeLock sync.Mutex
+	mu        sync.RWMutex
+	f         *os.File
+	size      int64
+	entries   map[string]packEntry
+	dead      int64
+}
+
+func OpenPack(path string) (*PackBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &PackBackend{
+		path:    path,
+		f:       f,
+		entries: make(map[string]packEntry),
+	}
+
+	if err := b.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	live := b.size - b.dead
+	if b.dead > packCompactThreshold && b.dead > live {
+		if err := b.compact(); err != nil {
+			b.f.Close()
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func (b *PackBackend) Close() error {
+	return b.f.Close()
+}
+
+// load scans the pack and indexes its records. Every record before the
+// last one was synced before the next was started, so only the last can be
+// torn by a crash, and it is cut off if it is. A damaged record anywhere
+// else fails the load and leaves the pack untouched.
+func (b *PackBackend) load() error {
+	stat, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := stat.Size()
+
+	header := make([]byte, len(packMagic)+1)
+	if fileSize == 0 {
+		copy(header, packMagic)
+		header[len(packMagic)] = packVersion
+		if _, err := b.f.WriteAt(header, 0); err != nil {
+			return err
+		}
+		b.size = int64(len(header))
+		return b.f.Sync()
+	}
+
+	if _, err := b.f.ReadAt(header, 0); err != nil || !bytes.Equal(header[:len(packMagic)], packMagic) {
+		return fmt.Errorf("%s: %w", b.path, ErrNotPack)
+	}
+	if header[len(packMagic)] != packVersion {
+		return fmt.Errorf("%s: unsupported pack version %d", b.path, header[len(packMagic)])
+	}
+
+	off := int64(len(header))
+	for off < fileSize {
+		e, op, err := b.readRecord(off, fileSize)
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+
+		prev, ok := b.entries[e.info.Key]
+		if ok {
+			b.dead += prev.end - prev.offset
+		}
+		if op == opDelete {
+			delete(b.entries, e.info.Key)
+			b.dead += e.end - e.offset
+		} else {
+			b.entries[e.info.Key] = *e
+		}
+		off = e.end
+	}
+
+	if off < fileSize {
+		if err := b.f.Truncate(off); err != nil {
+			return err
+		}
+		if err := b.f.Sync(); err != nil {
+			return err
+		}
+	}
+	b.size = off
+
+	return nil
+}
+
+// readRecord decodes the record at off, returning a nil entry if it is the
+// torn last record: cut short, or still pending. Any other record that fails
+// its checks, CRC included, is reported as ErrPackCorrupt.
+func (b *PackBackend) readRecord(off, fileSize int64) (*packEntry, byte, error) {
+	header := make([]byte, packRecordHeaderSize)
+	if off+packRecordHeaderSize > fileSize {
+		return nil, 0, nil
+	}
+	if _, err := b.f.ReadAt(header, off); err != nil {
+		return nil, 0, err
+	}
+
+	op := header[0]
+	keyLen := int64(binary.BigEndian.Uint32(header[1:5]))
+	dataLen := int64(binary.BigEndian.Uint64(header[5:13]))
+	created := int64(binary.BigEndian.Uint64(header[13:21]))
+	modified := int64(binary.BigEndian.Uint64(header[21:29]))
+	checksum := header[29 : 29+sha256.Size]
+	crc := binary.BigEndian.Uint32(header[29+sha256.Size:])
+
+	corrupt := fmt.Errorf("%s: record at offset %d: %w", b.path, off, ErrPackCorrupt)
+
+	// A pending record has nothing but its key length filled in, as
+	// appendRecord writes the rest of the header last.
+	if op == opPending {
+		if !bytes.Equal(header[5:], make([]byte, len(header)-5)) {
+			return nil, 0, corrupt
+		}
+		return nil, 0, nil
+	}
+
+	keyOff := off + packRecordHeaderSize
+	end := keyOff + keyLen + dataLen
+	if (op != opPut && op != opDelete) || dataLen < 0 || end < keyOff {
+		return nil, 0, corrupt
+	}
+	if end > fileSize {
+		return nil, 0, nil
+	}
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(b.f, keyOff, keyLen+dataLen)); err != nil {
+		return nil, 0, err
+	}
+	if h.Sum32() != crc {
+		// The last record may have had its header written but not all
+		// of its data.
+		if end == fileSize {
+			return nil, 0, nil
+		}
+		return nil, 0, corrupt
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := b.f.ReadAt(key, keyOff); err != nil {
+		return nil, 0, err
+	}
+
+	return &packEntry{
+		info: KeyInfo{
+			Key:      string(key),
+			Size:     dataLen,
+			Created:  time.Unix(0, created),
+			Modified: time.Unix(0, modified),
+			Checksum: hex.EncodeToString(checksum),
+		},
+		offset:  off,
+		dataOff: keyOff + keyLen,
+		end:     end,
+	}, op, nil
+}
+
+// appendRecord writes a record at off in f. The record is first written as
+// pending and only gets its real op once the data is in place, synced in
+// between if durable is set.
+func appendRecord(f *os.File, off int64, op byte, info KeyInfo, r io.Reader, durable bool) (*packEntry, error) {
+	header := make([]byte, packRecordHeaderSize)
+	binary.BigEndian.PutUint32(header[1:5], uint32(len(info.Key)))
+	if _, err := f.WriteAt(header, off); err != nil {
+		return nil, err
+	}
+
+	keyOff := off + packRecordHeaderSize
+	if _, err := f.WriteAt([]byte(info.Key), keyOff); err != nil {
+		return nil, err
+	}
+
+	dataOff := keyOff + int64(len(info.Key))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(info.Key))
+	sum := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(io.NewOffsetWriter(f, dataOff), crc, sum), r)
+	if err != nil {
+		return nil, err
+	}
+
+	if durable {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	info.Size = n
+	info.Checksum = hex.EncodeToString(sum.Sum(nil))
+
+	header[0] = op
+	binary.BigEndian.PutUint64(header[5:13], uint64(n))
+	binary.BigEndian.PutUint64(header[13:21], uint64(info.Created.UnixNano()))
+	binary.BigEndian.PutUint64(header[21:29], uint64(info.Modified.UnixNano()))
+	copy(header[29:29+sha256.Size], sum.Sum(nil))
+	binary.BigEndian.PutUint32(header[29+sha256.Size:], crc.Sum32())
+	if _, err := f.WriteAt(header, off); err != nil {
+		return nil, err
+	}
+
+	if durable {
+		if err := f.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &packEntry{
+		info:    info,
+		offset:  off,
+		dataOff: dataOff,
+		end:     dataOff + n,
+	}, nil
+}
+
+func (b *PackBackend) append(op byte, key string, r io.Reader) (*packEntry, error) {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+
+	b.mu.RLock()
+	off := b.size
+	prev, exists := b.entries[key]
+	b.mu.RUnlock()
+
+	if op == opDelete && !exists {
+		return nil, nil
+	}
+
+	now := time.Now()
+	info := KeyInfo{Key: key, Created: now, Modified: now}
+	if exists {
+		info.Created = prev.info.Created
+	}
+
+	e, err := appendRecord(b.f, off, op, info, r, true)
+	if err != nil {
+		// Drop whatever part of the record made it in.
+		b.f.Truncate(off)
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.size = e.end
+	if exists {
+		b.dead += prev.end - prev.offset
+	}
+	if op == opDelete {
+		delete(b.entries, key)
+		b.dead += e.end - e.offset
+	} else {
+		b.entries[key] = *e
+	}
+
+	return e, nil
+}
+
+// compact rewrites the pack with only the latest record of each live key.
+func (b *PackBackend) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+tempMarker+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	header := append(bytes.Clone(packMagic), packVersion)
+	if _, err := tmp.WriteAt(header, 0); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	entries := make(map[string]packEntry, len(b.entries))
+	off := int64(len(header))
+	for key, old := range b.entries {
+		e, err := appendRecord(tmp, off, opPut, old.info, io.NewSectionReader(b.f, old.dataOff, old.info.Size), false)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		entries[key] = *e
+		off = e.end
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(b.path)); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	b.f.Close()
+	b.f = tmp
+	b.entries = entries
+	b.size = off
+	b.dead = 0
+
+	return nil
+}
+
+func (b *PackBackend) Read(key string) (int64, io.ReadCloser, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.entries[key]
+	if !ok {
+		return 0, nil, fmt.Errorf("read %s: %w", key, fs.ErrNotExist)
+	}
+
+	return e.info.Size, io.NopCloser(io.NewSectionReader(b.f, e.dataOff, e.info.Size)), nil
+}
+
+func (b *PackBackend) Write(key string, r io.Reader) (int64, error) {
+	e, err := b.append(opPut, key, r)
+	if err != nil {
+		return 0, err
+	}
+
+	return e.info.Size, nil
+}
+
+func (b *PackBackend) Exists(key string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.entries[key]
+	return ok
+}
+
+func (b *PackBackend) Delete(key string) error {
+	_, err := b.append(opDelete, key, bytes.NewReader(nil))
+	return err
+}
+
+func (b *PackBackend) List(prefix string) ([]KeyInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	infos := []KeyInfo{}
+	for key, e := range b.entries {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, e.info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+func (b *PackBackend) Stat(key string) (KeyInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.entries[key]
+	if !ok {
+		return KeyInfo{}, fmt.Errorf("stat %s: %w", key, fs.ErrNotExist)
+	}
+
+	return e.info, nil
+}
@@ -3,12 +3,15 @@ package storage
 import (
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 type PathKey struct {
@@ -53,9 +56,17 @@ func DefaultPathTransformFunc(key string) PathKey {
 	}
 }
 
+// Storage is the on-disk Backend. Each key is stored as its own file, at a
+// path derived from the key by the PathTransformFunc.
 type Storage struct {
 	root              string
 	pathTransformFunc PathTransformFunc
+	// dirLock keeps Delete from pruning a directory while a write is
+	// using it.
+	dirLock      sync.RWMutex
+	indexLock    sync.Mutex
+	index        map[string]KeyInfo
+	indexRecords int
 }
 
 func NewStorage(root string, pathTransform PathTransformFunc) *Storage {
@@ -65,7 +76,7 @@ func NewStorage(root string, pathTransform PathTransformFunc) *Storage {
 	}
 }
 
-func (s *Storage) Read(key string) (int64, io.Reader, error) {
+func (s *Storage) Read(key string) (int64, io.ReadCloser, error) {
 	pathKey := s.pathTransformFunc(key)
 	filePath := fmt.Sprintf("%s/%s", s.root, pathKey.FullPath())
 
@@ -76,6 +87,7 @@ func (s *Storage) Read(key string) (int64, io.Reader, error) {
 
 	fileInfo, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 
@@ -86,20 +98,33 @@ func (s *Storage) Write(key string, r io.Reader) (int64, error) {
 	pathKey := s.pathTransformFunc(key)
 	path := fmt.Sprintf("%s/%s", s.root, pathKey.pathName)
 
+	filePath := fmt.Sprintf("%s/%s", s.root, pathKey.FullPath())
+
+	// Holding dirLock for the whole write keeps Delete from pruning the
+	// directory before the temp file lands in it.
+	s.dirLock.RLock()
+	defer s.dirLock.RUnlock()
+
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return 0, err
 	}
 
-	filePath := fmt.Sprintf("%s/%s", s.root, pathKey.FullPath())
-
-	f, err := os.Create(filePath)
+	h := sha256.New()
+	n, err := writeAtomic(filePath, io.TeeReader(r, h))
 	if err != nil {
-		return 0, nil
+		return 0, err
 	}
 
-	n, err := io.Copy(f, r)
-	if err != nil {
-		return 0, err
+	now := time.Now()
+	info := KeyInfo{
+		Key:      key,
+		Size:     n,
+		Created:  now,
+		Modified: now,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}
+	if err := s.appendIndex(indexRecord{Info: info}); err != nil {
+		return n, err
 	}
 
 	return n, nil
@@ -113,18 +138,42 @@ func (s *Storage) Exists(key string) bool {
 	return !errors.Is(err, os.ErrNotExist)
 }
 
+// Delete removes key's blob and then any of its parent directories that
+// are left empty, stopping at the first one still in use by another key.
 func (s *Storage) Delete(key string) error {
 	pathKey := s.pathTransformFunc(key)
-	firstPath := fmt.Sprintf("%s/%s", s.root, pathKey.FirstPath())
+	filePath := fmt.Sprintf("%s/%s", s.root, pathKey.FullPath())
 
-	err := os.RemoveAll(firstPath)
-	if err != nil {
+	s.dirLock.Lock()
+	err := os.Remove(filePath)
+	if err == nil {
+		s.pruneDirs(pathKey.pathName)
+	}
+	s.dirLock.Unlock()
+
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 
-	return nil
+	return s.appendIndex(indexRecord{Deleted: true, Info: KeyInfo{Key: key}})
+}
+
+// pruneDirs removes the empty directories along pathName, deepest first.
+// The caller must hold dirLock.
+func (s *Storage) pruneDirs(pathName string) {
+	paths := strings.Split(pathName, "/")
+	for i := len(paths); i > 0; i-- {
+		if err := os.Remove(fmt.Sprintf("%s/%s", s.root, strings.Join(paths[:i], "/"))); err != nil {
+			return
+		}
+	}
 }
 
 func (s *Storage) Reset() error {
+	s.indexLock.Lock()
+	s.index = nil
+	s.indexRecords = 0
+	s.indexLock.Unlock()
+
 	return os.RemoveAll(s.root)
 }
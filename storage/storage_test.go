@@ -2,8 +2,16 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -33,6 +41,7 @@ func TestStorage(t *testing.T) {
 	assert.Nil(t, err)
 
 	b, _ := io.ReadAll(r)
+	r.Close()
 
 	assert.Equal(t, data, b)
 
@@ -42,3 +51,388 @@ func TestStorage(t *testing.T) {
 
 	assert.Nil(t, s.Reset())
 }
+
+// sharedPrefixTransform puts every key in the same directory tree, so keys
+// only differ in their file names.
+func sharedPrefixTransform(key string) PathKey {
+	return PathKey{
+		pathName: "aaaaaaaaaa/bbbbbbbbbb",
+		fileName: key,
+	}
+}
+
+func TestDeleteCollidingPrefix(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(root, sharedPrefixTransform)
+
+	for _, key := range []string{"one", "two"} {
+		_, err := s.Write(key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, s.Delete("one"))
+	assert.False(t, s.Exists("one"))
+	assert.True(t, s.Exists("two"))
+
+	_, r, err := s.Read("two")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, []byte("two"), b)
+
+	assert.Nil(t, s.Delete("two"))
+	_, err = os.Stat(filepath.Join(root, "aaaaaaaaaa"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Nil(t, s.Delete("missing"))
+}
+
+func TestDeleteConcurrentWithSiblingWrites(t *testing.T) {
+	s := NewStorage(t.TempDir(), sharedPrefixTransform)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("key-%d", i)
+			for j := 0; j < 50; j++ {
+				_, err := s.Write(key, bytes.NewReader([]byte(key)))
+				assert.Nil(t, err)
+				assert.True(t, s.Exists(key))
+				assert.Nil(t, s.Delete(key))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	infos, err := s.List("")
+	assert.Nil(t, err)
+	assert.Empty(t, infos)
+}
+
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestWriteIsAtomic(t *testing.T) {
+	s := NewStorage(t.TempDir(), DefaultPathTransformFunc)
+
+	_, err := s.Write("key", bytes.NewReader([]byte("old data")))
+	assert.Nil(t, err)
+
+	_, err = s.Write("key", &failingReader{data: []byte("new da")})
+	assert.ErrorContains(t, err, "connection lost")
+
+	_, r, err := s.Read("key")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, []byte("old data"), b)
+
+	n, err := s.Recover()
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+}
+
+func TestWriteReportsErrors(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "file")
+	assert.Nil(t, os.WriteFile(root, nil, 0o644))
+
+	s := NewStorage(root, DefaultPathTransformFunc)
+	_, err := s.Write("key", bytes.NewReader([]byte("data")))
+	assert.NotNil(t, err)
+}
+
+func TestRecover(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(root, DefaultPathTransformFunc)
+
+	for _, key := range []string{"key", "other"} {
+		_, err := s.Write(key, bytes.NewReader([]byte("data")))
+		assert.Nil(t, err)
+	}
+
+	orphans := []string{}
+	for _, key := range []string{"key", "other"} {
+		pathKey := DefaultPathTransformFunc(key)
+		orphans = append(orphans, filepath.Join(root, pathKey.pathName, pathKey.fileName+tempMarker+"1234"))
+	}
+	for _, orphan := range orphans {
+		assert.Nil(t, os.WriteFile(orphan, []byte("partial"), 0o644))
+	}
+
+	n, err := s.Recover()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	for _, orphan := range orphans {
+		_, err := os.Stat(orphan)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+	assert.True(t, s.Exists("key"))
+	assert.True(t, s.Exists("other"))
+}
+
+func TestChunkStore(t *testing.T) {
+	s := NewStore(NewStorage(t.TempDir(), DefaultPathTransformFunc))
+
+	n, err := s.WriteChunk("aabbcc", bytes.NewReader([]byte("chunk data")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+	assert.True(t, s.HasChunk("aabbcc"))
+
+	n, err = s.WriteChunk("aabbcc", bytes.NewReader([]byte("ignored")))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+
+	r, err := s.ReadChunk("aabbcc")
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, []byte("chunk data"), b)
+
+	_, err = s.WriteChunk("../escape", bytes.NewReader(nil))
+	assert.NotNil(t, err)
+}
+
+func TestPruneChunks(t *testing.T) {
+	s := NewStore(NewStorage(t.TempDir(), DefaultPathTransformFunc))
+
+	for _, hash := range []string{"aa01", "aa02", "bb03"} {
+		_, err := s.WriteChunk(hash, bytes.NewReader([]byte(hash)))
+		assert.Nil(t, err)
+	}
+
+	m := &Manifest{Size: 8, Chunks: []ChunkRef{{Hash: "aa01", Size: 4}, {Hash: "bb03", Size: 4}}}
+	assert.Nil(t, s.WriteManifest("testkey", m))
+
+	read, err := s.ReadManifest("testkey")
+	assert.Nil(t, err)
+	assert.Equal(t, m, read)
+
+	pruned, err := s.PruneChunks(time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+
+	pruned, err = s.PruneChunks(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+
+	chunks, err := s.Chunks()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"aa01", "bb03"}, chunks)
+}
+
+func TestManifestsSkipsUndecodable(t *testing.T) {
+	s := NewStore(NewMemoryBackend())
+
+	assert.Nil(t, s.WriteManifest("good", &Manifest{Size: 4, Chunks: []ChunkRef{{Hash: "aa01", Size: 4}}}))
+	_, err := s.Backend().Write("broken", bytes.NewReader(append(bytes.Clone(manifestMagic), "garbage"...)))
+	assert.Nil(t, err)
+
+	manifests, err := s.Manifests()
+	assert.Nil(t, err)
+	if assert.Len(t, manifests, 1) {
+		assert.Equal(t, int64(4), manifests[0].Size)
+	}
+
+	_, err = s.PruneChunks(0)
+	assert.Nil(t, err)
+}
+
+func TestVersions(t *testing.T) {
+	s := NewStore(NewMemoryBackend())
+
+	key := "docs/report"
+	start := time.Now().Add(-time.Hour)
+	var ids []string
+	for i := 0; i < 4; i++ {
+		hash := fmt.Sprintf("aa0%d", i)
+		_, err := s.WriteChunk(hash, bytes.NewReader([]byte(hash)))
+		assert.Nil(t, err)
+
+		modified := start.Add(time.Duration(i) * time.Minute)
+		m := &Manifest{
+			Key:       key,
+			Version:   NewVersionID(modified),
+			Versioned: true,
+			Size:      4,
+			Modified:  modified,
+			Chunks:    []ChunkRef{{Hash: hash, Size: 4}},
+		}
+		assert.Nil(t, s.WriteManifest(key, m))
+		ids = append(ids, m.Version)
+	}
+
+	versions, err := s.Versions(key)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 4)
+	assert.Equal(t, ids[0], versions[0].Version)
+
+	keys, err := s.VersionedKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// Archived versions keep their chunks alive.
+	pruned, err := s.PruneChunks(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, pruned)
+
+	pruned, err = s.PruneVersions(key, RetentionPolicy{MaxVersions: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, pruned)
+	_, err = s.ReadVersion(key, ids[0])
+	assert.NotNil(t, err)
+
+	pruned, err = s.PruneVersions(key, RetentionPolicy{MaxAge: time.Minute})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, pruned)
+
+	// The current version outlives any policy.
+	versions, err = s.Versions(key)
+	assert.Nil(t, err)
+	if assert.Len(t, versions, 1) {
+		assert.Equal(t, ids[3], versions[0].Version)
+	}
+
+	pruned, err = s.PruneChunks(0)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, pruned)
+
+	vkey, err := versionKey(key, ids[3])
+	assert.Nil(t, err)
+	gotKey, gotID, ok := VersionOf(vkey)
+	assert.True(t, ok)
+	assert.Equal(t, key, gotKey)
+	assert.Equal(t, ids[3], gotID)
+	assert.ErrorIs(t, ValidateKey(vkey), ErrReservedKey)
+}
+
+func TestKeyIndex(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(root, DefaultPathTransformFunc)
+
+	for _, key := range []string{"logs/b", "logs/a", "photos/c"} {
+		_, err := s.Write(key, bytes.NewReader([]byte(key)))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, s.Delete("logs/b"))
+
+	infos, err := s.List("logs/")
+	assert.Nil(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "logs/a", infos[0].Key)
+		assert.Equal(t, int64(6), infos[0].Size)
+		assert.NotEmpty(t, infos[0].Checksum)
+	}
+
+	created := infos[0].Created
+	_, err = s.Write("logs/a", bytes.NewReader([]byte("rewritten")))
+	assert.Nil(t, err)
+
+	// A fresh Storage over the same root reads the persisted index.
+	s = NewStorage(root, DefaultPathTransformFunc)
+	info, err := s.Stat("logs/a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), info.Size)
+	assert.True(t, info.Created.Equal(created))
+
+	keys := []string{}
+	assert.Nil(t, s.Walk(func(info KeyInfo) error {
+		keys = append(keys, info.Key)
+		return nil
+	}))
+	assert.Equal(t, []string{"logs/a", "photos/c"}, keys)
+
+	_, err = s.Stat("logs/b")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestKeyIndexRecovery(t *testing.T) {
+	root := t.TempDir()
+	s := NewStorage(root, DefaultPathTransformFunc)
+
+	assert.Nil(t, NewStore(s).WriteManifest("file", &Manifest{Key: "file", Size: 42}))
+	_, err := s.Write("blob", bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+
+	// A torn final record is dropped.
+	f, err := os.OpenFile(filepath.Join(root, indexFile), os.O_APPEND|os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	f.WriteString(`{"info":{"Key":"torn`)
+	f.Close()
+
+	s = NewStorage(root, DefaultPathTransformFunc)
+	infos, err := s.List("")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 2)
+
+	// Records appended after recovering from a torn one are kept.
+	_, err = s.Write("after", bytes.NewReader([]byte("data")))
+	assert.Nil(t, err)
+	infos, err = NewStorage(root, DefaultPathTransformFunc).List("")
+	assert.Nil(t, err)
+	assert.Len(t, infos, 3)
+
+	// Without an index, keys are recovered from the manifests, and the
+	// chunks from the manifests that refer to them.
+	hash := "0123456789abcdef"
+	_, err = NewStore(s).WriteChunk(hash, bytes.NewReader([]byte("chunk")))
+	assert.Nil(t, err)
+	assert.Nil(t, NewStore(s).WriteManifest("file", &Manifest{Key: "file", Size: 42, Chunks: []ChunkRef{{Hash: hash, Size: 5}}}))
+
+	assert.Nil(t, os.Remove(filepath.Join(root, indexFile)))
+	store := NewStore(NewStorage(root, DefaultPathTransformFunc))
+	infos, err = store.List("")
+	assert.Nil(t, err)
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, "file", infos[0].Key)
+		assert.Equal(t, int64(42), infos[0].Size)
+	}
+	chunks, err := store.Chunks()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{hash}, chunks)
+
+	// Rebuilt entries carry checksums, so the scrubber can check them.
+	blobs, err := store.Blobs()
+	assert.Nil(t, err)
+	assert.Len(t, blobs, 2)
+	digest := sha256.Sum256([]byte("chunk"))
+	for _, info := range blobs {
+		assert.NotEmpty(t, info.Checksum, info.Key)
+		if info.Key == chunkPrefix+hash {
+			assert.Equal(t, hex.EncodeToString(digest[:]), info.Checksum)
+		}
+	}
+}
+
+func TestVersionVector(t *testing.T) {
+	var empty VersionVector
+	a := empty.Increment("a")
+	ab := a.Increment("b")
+	ac := a.Increment("c")
+
+	assert.Equal(t, Equal, a.Compare(VersionVector{"a": 1}))
+	assert.Equal(t, Before, a.Compare(ab))
+	assert.Equal(t, After, ab.Compare(a))
+	assert.Equal(t, Concurrent, ab.Compare(ac))
+	assert.Equal(t, After, empty.Increment("a").Compare(empty))
+
+	merged := ab.Merge(ac)
+	assert.Equal(t, VersionVector{"a": 1, "b": 1, "c": 1}, merged)
+	assert.True(t, merged.Descends(ab))
+	assert.True(t, merged.Descends(ac))
+
+	// Increment and Merge leave their receiver alone.
+	assert.Equal(t, VersionVector{"a": 1}, a)
+}
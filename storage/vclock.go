@@ -0,0 +1,79 @@
+package storage
+
+import "maps"
+
+// VersionVector counts, per node, the writes to a key that a version of it
+// has seen. Comparing two vectors tells whether one version was written
+// with knowledge of the other or whether they were written concurrently.
+type VersionVector map[string]uint64
+
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (o Ordering) String() string {
+	switch o {
+	case Equal:
+		return "equal"
+	case Before:
+		return "before"
+	case After:
+		return "after"
+	}
+
+	return "concurrent"
+}
+
+// Compare orders v against o: Before if o has seen every write v has and
+// more, After for the reverse, and Concurrent if each has seen a write the
+// other has not.
+func (v VersionVector) Compare(o VersionVector) Ordering {
+	descends, descended := v.Descends(o), o.Descends(v)
+	switch {
+	case descends && descended:
+		return Equal
+	case descends:
+		return After
+	case descended:
+		return Before
+	}
+
+	return Concurrent
+}
+
+// Descends reports whether v has seen every write o has.
+func (v VersionVector) Descends(o VersionVector) bool {
+	for node, n := range o {
+		if v[node] < n {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Merge returns a vector that has seen every write v or o has.
+func (v VersionVector) Merge(o VersionVector) VersionVector {
+	merged := maps.Clone(v)
+	if merged == nil {
+		merged = make(VersionVector, len(o))
+	}
+	for node, n := range o {
+		merged[node] = max(merged[node], n)
+	}
+
+	return merged
+}
+
+// Increment returns a copy of v recording one more write by node.
+func (v VersionVector) Increment(node string) VersionVector {
+	next := v.Merge(nil)
+	next[node]++
+
+	return next
+}
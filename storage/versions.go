@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// versionPrefix holds the archived manifests of versioned files, one per
+// version, under the escaped file key.
+const versionPrefix = ".versions/"
+
+// RetentionPolicy bounds the history kept for a versioned file. A version
+// is pruned once it falls outside either limit; zero disables a limit. The
+// current version and its siblings are always kept.
+type RetentionPolicy struct {
+	// MaxVersions is how many versions, the current one included, are kept.
+	MaxVersions int
+	// MaxAge is how long after it was stored a version is kept.
+	MaxAge time.Duration
+}
+
+// NewVersionID returns a version ID for a file stored at t. IDs of later
+// versions sort after those of earlier ones.
+func NewVersionID(t time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return fmt.Sprintf("%016x-%s", t.UnixNano(), hex.EncodeToString(suffix))
+}
+
+func versionDir(key string) string {
+	return versionPrefix + url.PathEscape(key) + "/"
+}
+
+func versionKey(key, id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") {
+		return "", fmt.Errorf("invalid version ID %q", id)
+	}
+
+	return versionDir(key) + id, nil
+}
+
+// VersionOf returns the file key and version ID of the archived version
+// stored under the backend key, and false if key holds none.
+func VersionOf(backendKey string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(backendKey, versionPrefix)
+	if !ok {
+		return "", "", false
+	}
+
+	escaped, id, ok := strings.Cut(rest, "/")
+	if !ok {
+		return "", "", false
+	}
+	key, err := url.PathUnescape(escaped)
+	if err != nil {
+		return "", "", false
+	}
+
+	return key, id, true
+}
+
+// WriteVersion archives m as version m.Version of key.
+func (s *Store) WriteVersion(key string, m *Manifest) error {
+	vkey, err := versionKey(key, m.Version)
+	if err != nil {
+		return err
+	}
+
+	return s.writeManifest(vkey, m)
+}
+
+// ReadVersion reads version id of key. Besides archived versions, that can
+// be any head of the current manifest, which covers the siblings of a file
+// that is not versioned.
+func (s *Store) ReadVersion(key, id string) (*Manifest, error) {
+	vkey, err := versionKey(key, id)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.readManifest(vkey)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return m, err
+	}
+
+	if current, cerr := s.ReadManifest(key); cerr == nil {
+		for _, head := range current.Heads() {
+			if head.Version == id {
+				return head, nil
+			}
+		}
+	}
+
+	return nil, err
+}
+
+// Versions returns the archived versions of key, oldest first.
+func (s *Store) Versions(key string) ([]*Manifest, error) {
+	return s.versions(versionDir(key))
+}
+
+// AllVersions returns the archived versions of every file.
+func (s *Store) AllVersions() ([]*Manifest, error) {
+	return s.versions(versionPrefix)
+}
+
+func (s *Store) versions(prefix string) ([]*Manifest, error) {
+	infos, err := s.backend.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*Manifest{}
+	for _, info := range infos {
+		m, err := s.readManifest(info.Key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			log.Printf("skipping version %s: %v", info.Key, err)
+			continue
+		}
+
+		versions = append(versions, m)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+
+	return versions, nil
+}
+
+// VersionedKeys returns the keys of the files that have archived versions.
+func (s *Store) VersionedKeys() ([]string, error) {
+	infos, err := s.backend.List(versionPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, info := range infos {
+		key, _, ok := VersionOf(info.Key)
+		if ok && (len(keys) == 0 || keys[len(keys)-1] != key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// PruneVersions deletes the archived versions of key that policy no longer
+// keeps, returning how many were removed.
+func (s *Store) PruneVersions(key string, policy RetentionPolicy) (int, error) {
+	versions, err := s.Versions(key)
+	if err != nil {
+		return 0, err
+	}
+
+	current := make(map[string]bool)
+	if m, err := s.ReadManifest(key); err == nil {
+		for _, head := range m.Heads() {
+			current[head.Version] = true
+		}
+	}
+
+	pruned := 0
+	cutoff := time.Now().Add(-policy.MaxAge)
+	for i, m := range versions {
+		tooMany := policy.MaxVersions > 0 && len(versions)-i > policy.MaxVersions
+		tooOld := policy.MaxAge > 0 && m.Modified.Before(cutoff)
+		if current[m.Version] || (!tooMany && !tooOld) {
+			continue
+		}
+
+		vkey, err := versionKey(key, m.Version)
+		if err != nil {
+			return pruned, err
+		}
+		if err := s.backend.Delete(vkey); err != nil {
+			return pruned, err
+		}
+		pruned++
+	}
+
+	return pruned, nil
+}